@@ -0,0 +1,360 @@
+package decoder
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TorrentVersion selects the metadata written by CreateTorrent.
+type TorrentVersion int
+
+const (
+	TorrentV1     TorrentVersion = iota // pieces only
+	TorrentV2                           // file tree and piece layers only (BEP 52)
+	TorrentHybrid                       // both, with v1 files padded to piece boundaries
+)
+
+// Piece lengths chosen by CreateTorrent when none is given.
+const (
+	minPieceLength    = 16 * 1024
+	maxPieceLength    = 16 * 1024 * 1024
+	targetPieceNumber = 1500
+)
+
+type CreateOptions struct {
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	// CreationDate defaults to the current time
+	CreationDate time.Time
+	Private      bool
+	WebSeeds     []string
+	// PieceLength must be a power of two, 0 picks one from the total size
+	PieceLength int
+	Version     TorrentVersion
+	// Workers is the number of hashing goroutines, 0 uses one per CPU
+	Workers int
+}
+
+// sourceFile is a file found under the path given to CreateTorrent.
+type sourceFile struct {
+	abs    string
+	path   []string // relative to the torrent root, empty for a single file
+	length int
+}
+
+/*
+CreateTorrent builds the metainfo for the file or directory at path.
+Directories are walked recursively and their regular files are added in
+sorted order, empty directories are left out.
+*/
+func CreateTorrent(path string, opts CreateOptions) (MetaInfo, error) {
+	files, e := collectFiles(path)
+	if e != nil {
+		return MetaInfo{}, e
+	}
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	}
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return MetaInfo{}, fmt.Errorf("piece length %d is not a power of two of at least 16 KiB", pieceLength)
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	info := Info{
+		Name:        filepath.Base(filepath.Clean(path)),
+		PieceLength: pieceLength,
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+	metaInfo := MetaInfo{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		UrlList:      opts.WebSeeds,
+	}
+	date := opts.CreationDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	metaInfo.CreationDate = date.Unix()
+
+	if opts.Version == TorrentV2 || opts.Version == TorrentHybrid {
+		tree, layers, e := hashV2(files, pieceLength, workers)
+		if e != nil {
+			return MetaInfo{}, e
+		}
+		info.MetaVersion = 2
+		info.FileTree = tree
+		if len(layers) > 0 {
+			metaInfo.PieceLayers = layers
+		}
+	}
+	if opts.Version == TorrentV1 || opts.Version == TorrentHybrid {
+		pad := opts.Version == TorrentHybrid
+		setV1Files(&info, files, pad)
+		pieces, e := hashV1(files, info, workers)
+		if e != nil {
+			return MetaInfo{}, e
+		}
+		info.Pieces = pieces
+	}
+
+	metaInfo.Info = info
+	metaInfo.InfoBytes, e = Marshal(info)
+	if e != nil {
+		return MetaInfo{}, e
+	}
+	return metaInfo, nil
+}
+
+func collectFiles(root string) ([]sourceFile, error) {
+	stat, e := os.Stat(root)
+	if e != nil {
+		return nil, e
+	}
+	if !stat.IsDir() {
+		return []sourceFile{{abs: root, length: int(stat.Size())}}, nil
+	}
+
+	files := []sourceFile{}
+	e = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		stat, e := d.Info()
+		if e != nil {
+			return e
+		}
+		rel, e := filepath.Rel(root, p)
+		if e != nil {
+			return e
+		}
+		files = append(files, sourceFile{
+			abs:    p,
+			path:   strings.Split(filepath.ToSlash(rel), "/"),
+			length: int(stat.Size()),
+		})
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files to add to the torrent")
+	}
+	return files, nil
+}
+
+// choosePieceLength aims for about targetPieceNumber pieces.
+func choosePieceLength(total int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && total/pieceLength > targetPieceNumber {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+/*
+setV1Files fills the v1 file fields of info. With pad every file but the
+last is followed by a BEP 47 padding file so that files start on a piece
+boundary, as hybrid torrents require.
+*/
+func setV1Files(info *Info, files []sourceFile, pad bool) {
+	if len(files) == 1 && files[0].path == nil {
+		info.Length = files[0].length
+		return
+	}
+	for i, f := range files {
+		info.Files = append(info.Files, File{Length: f.length, Path: f.path})
+		rest := f.length % info.PieceLength
+		if pad && rest != 0 && i < len(files)-1 {
+			size := info.PieceLength - rest
+			info.Files = append(info.Files, File{
+				Length: size,
+				Path:   []string{".pad", strconv.Itoa(size)},
+				Attr:   "p",
+			})
+		}
+	}
+}
+
+// runParallel runs jobs on the given number of goroutines and returns the first error.
+func runParallel(workers int, jobs []func() error) error {
+	queue := make(chan func() error)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if e := job(); e != nil {
+					once.Do(func() { firstErr = e })
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+func openFiles(files []sourceFile) ([]*os.File, func(), error) {
+	opened := make([]*os.File, len(files))
+	closeAll := func() {
+		for _, f := range opened {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}
+	for i, f := range files {
+		file, e := os.Open(f.abs)
+		if e != nil {
+			closeAll()
+			return nil, nil, e
+		}
+		opened[i] = file
+	}
+	return opened, closeAll, nil
+}
+
+// hashV1 computes the SHA-1 of every piece of the concatenated v1 files of info.
+func hashV1(files []sourceFile, info Info, workers int) ([]byte, error) {
+	opened, closeAll, e := openFiles(files)
+	if e != nil {
+		return nil, e
+	}
+	defer closeAll()
+
+	// layout entries are the source files plus the padding files between them
+	layout := info.Layout()
+	source := make([]*os.File, len(layout))
+	next := 0
+	for i, entry := range layout {
+		if !entry.IsPadding() {
+			source[i] = opened[next]
+			next++
+		}
+	}
+
+	pieces := make([]byte, sha1.Size*info.NumPieces())
+	jobs := []func() error{}
+	for index := range info.NumPieces() {
+		jobs = append(jobs, func() error {
+			piece := make([]byte, info.PieceSize(index))
+			read := 0
+			for _, span := range layout.Spans(index*info.PieceLength, len(piece)) {
+				data := piece[read : read+span.Length]
+				read += span.Length
+				if source[span.File] == nil {
+					continue // padding is zeros
+				}
+				if _, e := source[span.File].ReadAt(data, int64(span.FileOffset)); e != nil {
+					return fmt.Errorf("reading %s: %w", layout[span.File].RelPath(), e)
+				}
+			}
+			hash := sha1.Sum(piece)
+			copy(pieces[index*sha1.Size:], hash[:])
+			return nil
+		})
+	}
+	return pieces, runParallel(workers, jobs)
+}
+
+// hashV2 builds the v2 file tree and the piece layers of files larger than a piece.
+func hashV2(files []sourceFile, pieceLength int, workers int) (map[string]any, map[string][]byte, error) {
+	opened, closeAll, e := openFiles(files)
+	if e != nil {
+		return nil, nil, e
+	}
+	defer closeAll()
+
+	layers := make([][]byte, len(files))
+	jobs := []func() error{}
+	for i, f := range files {
+		numPieces := (f.length + pieceLength - 1) / pieceLength
+		layers[i] = make([]byte, numPieces*sha256.Size)
+		for p := range numPieces {
+			jobs = append(jobs, func() error {
+				piece := make([]byte, min(pieceLength, f.length-p*pieceLength))
+				_, e := opened[i].ReadAt(piece, int64(p*pieceLength))
+				if e != nil && e != io.EOF {
+					return fmt.Errorf("reading %s: %w", f.abs, e)
+				}
+				var hash []byte
+				if numPieces == 1 {
+					// a file of one piece is not padded to the piece length
+					hash = MerkleRoot(MerkleBlockHashes(piece), make([]byte, sha256.Size))
+				} else {
+					hash = PieceHashV2(piece, pieceLength)
+				}
+				copy(layers[i][p*sha256.Size:], hash)
+				return nil
+			})
+		}
+	}
+	if e := runParallel(workers, jobs); e != nil {
+		return nil, nil, e
+	}
+
+	tree := map[string]any{}
+	pieceLayers := map[string][]byte{}
+	for i, f := range files {
+		attrs := map[string]any{"length": f.length}
+		if f.length > 0 {
+			root := layers[i]
+			if f.length > pieceLength {
+				root = PieceLayerRoot(layers[i], pieceLength)
+				pieceLayers[string(root)] = layers[i]
+			}
+			attrs["pieces root"] = string(root)
+		}
+		path := f.path
+		if path == nil {
+			path = []string{filepath.Base(f.abs)}
+		}
+		node := tree
+		for _, dir := range path[:len(path)-1] {
+			child, ok := node[dir].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[dir] = child
+			}
+			node = child
+		}
+		node[path[len(path)-1]] = map[string]any{"": attrs}
+	}
+	return tree, pieceLayers, nil
+}
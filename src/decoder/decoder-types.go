@@ -1,86 +1,184 @@
 package decoder
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
-	"log"
+	"fmt"
 	"os"
-
-	"github.com/jackpal/bencode-go"
 )
 
-
 type Info struct {
 	Name        string `bencode:"name"`
-	Length      int    `bencode:"length"` // Solo para archivos de una sola pieza
+	Length      int    `bencode:"length,omitempty"` // Solo para torrents de un solo archivo
+	Md5sum      string `bencode:"md5sum,omitempty"`
+	Files       []File `bencode:"files,omitempty"` // Solo para torrents de varios archivos
 	PieceLength int    `bencode:"piece length"`
-	Pieces      []byte `bencode:"pieces"`
+	Pieces      []byte `bencode:"pieces,omitempty"`
+	Private     int    `bencode:"private,omitempty"`
+	// BitTorrent v2 (BEP 52), the file tree is walked with V2Files
+	MetaVersion int            `bencode:"meta version,omitempty"`
+	FileTree    map[string]any `bencode:"file tree,omitempty"`
 }
 
 type MetaInfo struct {
-	Announce string `bencode:"announce"`
-	Info     Info   `bencode:"info"`
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	UrlList      URLList    `bencode:"url-list,omitempty"` // web seeds (BEP 19)
+	Info         Info       `bencode:"-"`
+	// InfoBytes holds the info dictionary exactly as it appears in the
+	// torrent, the info hash is computed over these bytes.
+	InfoBytes RawMessage `bencode:"info"`
+	// PieceLayers maps the pieces root of each v2 file larger than a piece
+	// to the concatenated SHA-256 hashes of its pieces.
+	PieceLayers map[string][]byte `bencode:"piece layers,omitempty"`
 }
 
-func GetMetaInfo(m map[string]any) (MetaInfo, error) {
-	infoMap := m["info"].(map[string]any)
-	name := infoMap["name"].(string)
-	lengthD:= infoMap["length"]
-    if lengthD == nil{
-        //todo multi file
-        return MetaInfo{},errors.New("NO multifile decoder")
-    }        
-    length:=lengthD.(int)
-    pLen := infoMap["piece length"].(int)
-	pieces := infoMap["pieces"].([]byte)
-	info := Info{
-		Name:        name,
-		Length:      length,
-		PieceLength: pLen,
-		Pieces:      pieces,
-	}
-	announce := m["announce"].(string)
-	metaInfo := MetaInfo{
-		Announce: announce,
-		Info:     info,
+/*
+URLList is a list of URLs that torrents may also store as a single string,
+as it happens with url-list.
+*/
+type URLList []string
+
+func (l *URLList) UnmarshalBencode(data []byte) error {
+	var single string
+	if Unmarshal(data, &single) == nil {
+		*l = URLList{single}
+		return nil
 	}
-	return metaInfo, nil
+	var list []string
+	if e := Unmarshal(data, &list); e != nil {
+		return e
+	}
+	*l = list
+	return nil
 }
 
-func MetaInfoFromFile(path string) (MetaInfo,[]byte, error) {
+// ParseMetaInfo decodes and validates the content of a .torrent file.
+func ParseMetaInfo(content []byte) (MetaInfo, error) {
+	var metaInfo MetaInfo
+	if e := Unmarshal(content, &metaInfo); e != nil {
+		return MetaInfo{}, e
+	}
+	if len(metaInfo.InfoBytes) == 0 {
+		return MetaInfo{}, errors.New("missing info dictionary")
+	}
+	if e := Unmarshal(metaInfo.InfoBytes, &metaInfo.Info); e != nil {
+		return MetaInfo{}, e
+	}
+	if e := metaInfo.validate(); e != nil {
+		return MetaInfo{}, fmt.Errorf("invalid info: %w", e)
+	}
+	return metaInfo, nil
+}
 
+func MetaInfoFromFile(path string) (MetaInfo, []byte, error) {
 	content, e := os.ReadFile(path)
 	if e != nil {
-		log.Println("Error reading file. ", e)
-		os.Exit(1)
+		return MetaInfo{}, nil, e
 	}
-	decoded_bytes, e := Decode(content)
+	metaInfo, e := ParseMetaInfo(content)
 	if e != nil {
-		return MetaInfo{},nil, e
+		return MetaInfo{}, nil, e
 	}
-	dict, _ := decoded_bytes.(map[string]any)
-    metaInfo,e:=GetMetaInfo(dict)
-	if e != nil {
-		return MetaInfo{}, nil,e
+	return metaInfo, metaInfo.PeerInfoHash(), nil
+}
+
+func (m MetaInfo) validate() error {
+	if e := m.Info.validate(); e != nil {
+		return e
+	}
+	if m.Info.IsV2() {
+		// hybrid torrents can be verified with the v1 hashes, as from a magnet link without the layers
+		return m.validatePieceLayers(!m.Info.IsHybrid())
+	}
+	return nil
+}
+
+func (i Info) validate() error {
+	if i.MetaVersion != 0 && i.MetaVersion != 2 {
+		return fmt.Errorf("unsupported meta version %d", i.MetaVersion)
+	}
+	if !i.IsV1() && !i.IsV2() {
+		return errors.New("no v1 or v2 file information")
+	}
+	if i.IsV1() {
+		if e := i.validateV1(); e != nil {
+			return e
+		}
 	}
-    hash_encoded, _ := CalculateInfoHash(metaInfo.Info)
-	hash, _ := hex.DecodeString(hash_encoded)
-    return metaInfo,hash,nil
+	if i.IsV2() {
+		return i.validateV2()
+	}
+	return nil
+}
+
+/*
+MetaInfoFromInfoBytes builds a MetaInfo around a raw info dictionary, such
+as one fetched from peers for a magnet link. v2 piece layers are not part
+of the info dictionary and are left empty.
+*/
+func MetaInfoFromInfoBytes(infoBytes []byte, announce string) (MetaInfo, error) {
+	metaInfo := MetaInfo{Announce: announce, InfoBytes: infoBytes}
+	if e := Unmarshal(infoBytes, &metaInfo.Info); e != nil {
+		return MetaInfo{}, e
+	}
+	if e := metaInfo.Info.validate(); e != nil {
+		return MetaInfo{}, fmt.Errorf("invalid info: %w", e)
+	}
+	return metaInfo, nil
+}
+
+/*
+InfoHash returns the SHA-1 of the raw info dictionary. When the MetaInfo
+was not decoded from a torrent the info is encoded from Info instead.
+*/
+func (m MetaInfo) InfoHash() []byte {
+	raw := m.InfoBytes
+	if len(raw) == 0 {
+		raw, _ = Marshal(m.Info)
+	}
+	hash := sha1.Sum(raw)
+	return hash[:]
 }
 
 // Función para calcular el info hash
+// Only matches the torrent when Info holds every key of the original
+// dictionary, prefer MetaInfo.InfoHash.
 func CalculateInfoHash(info Info) (string, error) {
-	var buffer bytes.Buffer
-
-	err := bencode.Marshal(&buffer, info)
+	encoded, err := Marshal(info)
 	if err != nil {
 		return "", err
 	}
 
-	hash := sha1.Sum(buffer.Bytes())
+	hash := sha1.Sum(encoded)
 
 	// Convertir el hash a una cadena hexadecimal
 	return hex.EncodeToString(hash[:]), nil
 }
+
+/*
+AnnounceTiers returns the trackers of the torrent grouped in tiers. Per
+BEP 12 announce-list takes precedence over announce when present.
+*/
+func (m MetaInfo) AnnounceTiers() [][]string {
+	tiers := [][]string{}
+	for _, tier := range m.AnnounceList {
+		urls := []string{}
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	if len(tiers) == 0 && m.Announce != "" {
+		tiers = append(tiers, []string{m.Announce})
+	}
+	return tiers
+}
@@ -1,171 +1,390 @@
 package decoder
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
-	"unicode"
 )
 
+// Limits applied by a Decoder unless changed by the caller.
+const (
+	DefaultMaxDepth        = 256
+	DefaultMaxStringLength = 64 << 20
+)
+
+// maxDigits bounds the digits of an integer or string length so that a
+// stream of digits can never keep the decoder reading forever.
+const maxDigits = 20
+
+var (
+	ErrUnexpectedEOF = errors.New("unexpected end of input")
+	ErrInvalidByte   = errors.New("invalid byte")
+	ErrLeadingZero   = errors.New("leading zero")
+	ErrNegativeZero  = errors.New("negative zero")
+	ErrIntOverflow   = errors.New("integer overflow")
+	ErrStringTooLong = errors.New("string exceeds maximum length")
+	ErrNonStringKey  = errors.New("dictionary key is not a string")
+	ErrUnsortedKeys  = errors.New("dictionary keys are not sorted")
+	ErrDuplicateKey  = errors.New("duplicate dictionary key")
+	ErrTooDeep       = errors.New("maximum nesting depth exceeded")
+	ErrTrailingData  = errors.New("trailing data after value")
+)
+
+/*
+SyntaxError reports malformed bencode. Offset is the position of the byte
+that made the input invalid, counted from the first byte the decoder read.
+Err is one of the Err* values above and can be checked with errors.Is.
+*/
+type SyntaxError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %v at offset %d", e.Err, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// oneByteReader reads without buffering so the decoder never consumes
+// more of the underlying reader than the value it decodes.
+type oneByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+func (o *oneByteReader) ReadByte() (byte, error) {
+	_, e := io.ReadFull(o.r, o.buf[:])
+	return o.buf[0], e
+}
+
+/*
+Decoder reads bencoded values from a stream, one value per call to Decode.
+It reads byte by byte and never past the end of the value, so the reader
+can be shared with other consumers.
+*/
+type Decoder struct {
+	MaxDepth        int
+	MaxStringLength int
+
+	r      byteReader
+	offset int64
+	depth  int
+	// path holds the keys and list indexes leading to the value being decoded by DecodeInto
+	path []string
+
+	// capture collects the bytes read while a RawMessage is being decoded
+	capture *bytes.Buffer
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = &oneByteReader{r: r}
+	}
+	return &Decoder{
+		MaxDepth:        DefaultMaxDepth,
+		MaxStringLength: DefaultMaxStringLength,
+		r:               br,
+	}
+}
+
+// Offset returns the number of bytes consumed so far.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+/*
+Decode reads the next value. Integers are returned as int, strings as
+string, lists as []any and dictionaries as map[string]any.
+It returns io.EOF if the stream ends before the value starts.
+*/
+func (d *Decoder) Decode() (any, error) {
+	c, e := d.first()
+	if e != nil {
+		return nil, e
+	}
+	return d.value(c)
+}
+
+// first reads the opening byte of the next top level value.
+func (d *Decoder) first() (byte, error) {
+	c, e := d.r.ReadByte()
+	if e == io.EOF {
+		return 0, io.EOF
+	}
+	if e != nil {
+		return 0, d.readError(e)
+	}
+	d.offset++
+	d.depth = 0
+	d.path = d.path[:0]
+	return c, nil
+}
+
+/*
+DecodeReader decodes exactly one value from r and returns it together with
+the number of bytes consumed.
+*/
+func DecodeReader(r io.Reader) (any, int64, error) {
+	d := NewDecoder(r)
+	v, e := d.Decode()
+	if e == io.EOF {
+		e = &SyntaxError{Offset: 0, Err: ErrUnexpectedEOF}
+	}
+	return v, d.Offset(), e
+}
+
+// Decode decodes a buffer holding exactly one bencoded value.
 func Decode(bencode []byte) (any, error) {
-	if bencode[0] == 'i' { // number
-		return decode_int(string(bencode))
-	} else if unicode.IsNumber(rune(bencode[0])) { // string
-		return decode_string(bencode)
-	} else if bencode[0] == 'l' { // list
-		return decode_list(bencode)
-	} else if bencode[0] == 'd' { // dict
-		return decode_dict(bencode)
+	r := bytes.NewReader(bencode)
+	v, n, e := DecodeReader(r)
+	if e != nil {
+		return nil, e
 	}
-	return nil, fmt.Errorf("Error parsing code")
+	if r.Len() > 0 {
+		return nil, &SyntaxError{Offset: n, Err: ErrTrailingData}
+	}
+	return v, nil
+}
 
+func (d *Decoder) syntaxError(err error) error {
+	return &SyntaxError{Offset: d.offset - 1, Err: err}
+}
+
+func (d *Decoder) readError(e error) error {
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		return &SyntaxError{Offset: d.offset, Err: ErrUnexpectedEOF}
+	}
+	return e
 }
 
-func decode_bytes(bencode []byte) (any, error) {
-	return decode_dict(bencode)
+func (d *Decoder) readByte() (byte, error) {
+	c, e := d.r.ReadByte()
+	if e != nil {
+		return 0, d.readError(e)
+	}
+	d.offset++
+	if d.capture != nil {
+		d.capture.WriteByte(c)
+	}
+	return c, nil
 }
-func decode_string(bencode []byte) ([]byte, error) {
-	numbers := ""
-	var colonIndex int
 
-	if !(unicode.IsNumber(rune(bencode[0]))) { //if does not start with number
-		return nil, fmt.Errorf("String must start with a number")
+// value decodes the value whose first byte c has already been read.
+func (d *Decoder) value(c byte) (any, error) {
+	switch {
+	case c == 'i':
+		return d.integer()
+	case c >= '0' && c <= '9':
+		return d.str(c)
+	case c == 'l':
+		return d.list()
+	case c == 'd':
+		return d.dict()
 	}
-	for i, letter := range bencode {
-		if letter == ':' { // indicating end of number
-			colonIndex = i
-			break
+	return nil, d.syntaxError(ErrInvalidByte)
+}
+
+/*
+digits reads decimal digits up to the terminator byte, starting with first
+when it is non zero. Leading zeros are rejected.
+*/
+func (d *Decoder) digits(first byte, term byte) (string, error) {
+	buf := make([]byte, 0, maxDigits)
+	c := first
+	for {
+		if c == term && len(buf) > 0 {
+			return string(buf), nil
 		}
-		if unicode.IsNumber(rune(bencode[0])) { // if number
-			numbers += string(letter)
+		if c < '0' || c > '9' {
+			return "", d.syntaxError(ErrInvalidByte)
 		}
-	}
-	length, _ := strconv.Atoi(numbers)
-	if length+len(numbers)+1 != len(bencode) {
-		return nil, fmt.Errorf("Length for string is not correct, %d, %d", length+len(numbers)+1, len(bencode))
-	}
-
-	return bencode[colonIndex+1 : colonIndex+1+length], nil
-}
-
-func decode_int(bencode string) (int, error) {
-	if !(bencode[0] == 'i' && bencode[len(bencode)-1] == 'e') {
-		return 0, fmt.Errorf("Number must start with i and end with e")
-	}
-	return strconv.Atoi(bencode[1 : len(bencode)-1])
-}
-
-func decode_dict(bencode []byte) (map[string]any, error) {
-	if bencode[0] != 'd' {
-		return nil, fmt.Errorf("Dictionary must start with d")
-	}
-	result, _ := dict_rec(bencode[1:])
-	return result, nil
-}
-
-func dict_rec(bencode []byte) (map[string]any, []byte) {
-	var dict = make(map[string]any)
-
-	word := []byte{}
-	key := ""
-	var value any
-	//iterate all letters
-	for len(bencode) > 0 {
-		char := bencode[0]
-		bencode = bencode[1:] // -1 char
-
-		if char == 'd' && len(word) == 0 { // if dict
-			dict_res, code := dict_rec(bencode)
-			bencode = code
-			value = dict_res // set value to dict
-
-		} else if char == 'e' && len(word) == 0 { //if end of dict
-
-			return dict, bencode
-		} else if char == 'l' && len(word) == 0 { //todo
-			list_res, code := list_rec(bencode)
-			bencode = code
-			value = list_res // set value to dict
-
-		} else { // string or number
-			word = append(word, char)                       // add char to word
-			if word[0] == 'i' && word[len(word)-1] == 'e' { // number
-				number, _ := decode_int(string(word))
-				value = number
-			} else if unicode.IsDigit(rune(word[0])) {
-				result, _ := decode_string(word)
-				if result != nil {
-					if key == "" {
-						key = string(result)
-						dict[key] = nil
-						word = []byte{}
-					} else {
-						if key != "pieces" {
-							value = string(result)
-						} else {
-							value = result
-						}
-					}
-				}
-			}
+		if len(buf) == 1 && buf[0] == '0' {
+			return "", &SyntaxError{Offset: d.offset - 2, Err: ErrLeadingZero}
+		}
+		if len(buf) == maxDigits {
+			return "", d.syntaxError(ErrIntOverflow)
 		}
+		buf = append(buf, c)
 
-		if len(key) > 0 && value != nil {
-			dict[key] = value
-			key = ""
-			value = nil
-			word = []byte{}
+		var e error
+		if c, e = d.readByte(); e != nil {
+			return "", e
+		}
+	}
+}
+
+func (d *Decoder) integer() (int, error) {
+	c, e := d.readByte()
+	if e != nil {
+		return 0, e
+	}
+	negative := c == '-'
+	if negative {
+		if c, e = d.readByte(); e != nil {
+			return 0, e
 		}
 	}
-	return dict, bencode
+	start := d.offset - 1
+	num, e := d.digits(c, 'e')
+	if e != nil {
+		return 0, e
+	}
+	if negative && num == "0" {
+		return 0, &SyntaxError{Offset: start, Err: ErrNegativeZero}
+	}
+	if negative {
+		num = "-" + num
+	}
+	n, e := strconv.ParseInt(num, 10, 0)
+	if e != nil {
+		return 0, &SyntaxError{Offset: start, Err: ErrIntOverflow}
+	}
+	return int(n), nil
+}
+
+func (d *Decoder) str(first byte) (string, error) {
+	start := d.offset - 1
+	num, e := d.digits(first, ':')
+	if e != nil {
+		return "", e
+	}
+	length, e := strconv.ParseInt(num, 10, 64)
+	if e != nil || length > int64(d.MaxStringLength) {
+		return "", &SyntaxError{Offset: start, Err: ErrStringTooLong}
+	}
+	// copy in chunks so a bogus length cannot force a huge allocation
+	var buf bytes.Buffer
+	n, e := io.CopyN(&buf, d.r, length)
+	d.offset += n
+	if e != nil {
+		return "", d.readError(e)
+	}
+	if d.capture != nil {
+		d.capture.Write(buf.Bytes())
+	}
+	return buf.String(), nil
+}
+
+/*
+raw decodes the value starting with the already read byte c and returns its
+exact encoding. Nested calls share the capture buffer of the outermost one.
+*/
+func (d *Decoder) raw(c byte) ([]byte, error) {
+	outer := d.capture != nil
+	if !outer {
+		d.capture = new(bytes.Buffer)
+		d.capture.WriteByte(c)
+	}
+	start := d.capture.Len() - 1
+	_, e := d.value(c)
+	raw := bytes.Clone(d.capture.Bytes()[start:])
+	if !outer {
+		d.capture = nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	return raw, nil
 }
 
-func decode_list(bencode []byte) ([]any, error) {
-	if bencode[0] != 'l' {
-		return nil, fmt.Errorf("List must start with l")
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.depth > d.MaxDepth {
+		return d.syntaxError(ErrTooDeep)
 	}
-	result, _ := list_rec(bencode[1:])
-	return result, nil
+	return nil
 }
 
-func list_rec(bencode []byte) ([]any, []byte) {
+func (d *Decoder) list() ([]any, error) {
+	if e := d.enter(); e != nil {
+		return nil, e
+	}
 	list := []any{}
-	word := []byte{}
-	//iterate all letters
-	for len(bencode) > 0 {
-		char := bencode[0]
-		bencode = bencode[1:] // -1 char
-
-		if char == 'd' && len(word) == 0 { // if dict
-			dict_res, code := dict_rec(bencode)
-			bencode = code
-			list = append(list, dict_res) // set value to list
-
-		} else if char == 'e' && len(word) == 0 { //if end of list
-
-			return list, bencode
-		} else if char == 'l' && len(word) == 0 {
-			dict_res, code := list_rec(bencode)
-			bencode = code
-			list = append(list, dict_res) // set value to list
-
-		} else { // string or number
-			word = append(word, char)
-			if word[0] == 'i' && word[len(word)-1] == 'e' { // number
-				number, _ := decode_int(string(word))
-				list = append(list, number)
-				word = []byte{}
-
-			} else if unicode.IsDigit(rune(word[0])) {
-
-				result, _ := decode_string(word)
-				if result != nil {
-
-					list = append(list, result)
-					word = []byte{}
-				}
-			}
+	for {
+		c, e := d.readByte()
+		if e != nil {
+			return nil, e
+		}
+		if c == 'e' {
+			d.depth--
+			return list, nil
 		}
+		v, e := d.value(c)
+		if e != nil {
+			return nil, e
+		}
+		list = append(list, v)
+	}
+}
+
+/*
+dictKey reads the next dictionary key, checking the ordering rules against
+the previous one. It returns done when the end of the dictionary is found.
+*/
+func (d *Decoder) dictKey(prev *string, hasPrev bool) (key string, done bool, err error) {
+	c, e := d.readByte()
+	if e != nil {
+		return "", false, e
+	}
+	if c == 'e' {
+		return "", true, nil
 	}
-	return list, bencode
+	if c < '0' || c > '9' {
+		return "", false, d.syntaxError(ErrNonStringKey)
+	}
+	start := d.offset - 1
+	key, e = d.str(c)
+	if e != nil {
+		return "", false, e
+	}
+	if hasPrev && key == *prev {
+		return "", false, &SyntaxError{Offset: start, Err: ErrDuplicateKey}
+	}
+	if hasPrev && key < *prev {
+		return "", false, &SyntaxError{Offset: start, Err: ErrUnsortedKeys}
+	}
+	*prev = key
+	return key, false, nil
+}
 
+func (d *Decoder) dict() (map[string]any, error) {
+	if e := d.enter(); e != nil {
+		return nil, e
+	}
+	dict := make(map[string]any)
+	prev := ""
+	for hasPrev := false; ; hasPrev = true {
+		key, done, e := d.dictKey(&prev, hasPrev)
+		if e != nil {
+			return nil, e
+		}
+		if done {
+			d.depth--
+			return dict, nil
+		}
+		c, e := d.readByte()
+		if e != nil {
+			return nil, e
+		}
+		v, e := d.value(c)
+		if e != nil {
+			return nil, e
+		}
+		dict[key] = v
+	}
 }
@@ -0,0 +1,119 @@
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeValid(t *testing.T) {
+	cases := []struct {
+		input string
+		want  any
+	}{
+		{"i0e", 0},
+		{"i42e", 42},
+		{"i-42e", -42},
+		{"i9223372036854775807e", 9223372036854775807},
+		{"0:", ""},
+		{"4:spam", "spam"},
+		{"le", []any{}},
+		{"l4:spami42ee", []any{"spam", 42}},
+		{"de", map[string]any{}},
+		{"d3:bar4:spam3:fooi42ee", map[string]any{"bar": "spam", "foo": 42}},
+		{"d1:ad1:bli1eeee", map[string]any{"a": map[string]any{"b": []any{1}}}},
+	}
+	for _, c := range cases {
+		got, e := Decode([]byte(c.input))
+		if e != nil {
+			t.Errorf("Decode(%q): %v", c.input, e)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Decode(%q) = %#v, want %#v", c.input, got, c.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := []struct {
+		input  string
+		err    error
+		offset int64
+	}{
+		{"", ErrUnexpectedEOF, 0},
+		{"x", ErrInvalidByte, 0},
+		{"i03e", ErrLeadingZero, 1},
+		{"i-0e", ErrNegativeZero, 2},
+		{"03:abc", ErrLeadingZero, 0},
+		{"i1-2e", ErrInvalidByte, 2},
+		{"ie", ErrInvalidByte, 1},
+		{"i99999999999999999999e", ErrIntOverflow, 1},
+		// truncated
+		{"i12", ErrUnexpectedEOF, 3},
+		{"5:abc", ErrUnexpectedEOF, 5},
+		{"5", ErrUnexpectedEOF, 1},
+		{"li1e", ErrUnexpectedEOF, 4},
+		{"l4:spam", ErrUnexpectedEOF, 7},
+		{"d3:foo", ErrUnexpectedEOF, 6},
+		// dictionaries
+		{"d3:fooi1e3:bari2ee", ErrUnsortedKeys, 9},
+		{"d3:fooi1e3:fooi2ee", ErrDuplicateKey, 9},
+		{"di1ei2ee", ErrNonStringKey, 1},
+		{"i1ei2e", ErrTrailingData, 3},
+	}
+	for _, c := range cases {
+		_, e := Decode([]byte(c.input))
+		var syntax *SyntaxError
+		if !errors.As(e, &syntax) {
+			t.Errorf("Decode(%q) = %v, want a SyntaxError", c.input, e)
+			continue
+		}
+		if !errors.Is(e, c.err) || syntax.Offset != c.offset {
+			t.Errorf("Decode(%q) = %v, want %v at offset %d", c.input, e, c.err, c.offset)
+		}
+	}
+}
+
+func TestDecodeTooDeep(t *testing.T) {
+	input := bytes.Repeat([]byte("l"), DefaultMaxDepth+1)
+	input = append(input, bytes.Repeat([]byte("e"), DefaultMaxDepth+1)...)
+	if _, e := Decode(input); !errors.Is(e, ErrTooDeep) {
+		t.Errorf("Decode of %d nested lists = %v, want %v", DefaultMaxDepth+1, e, ErrTooDeep)
+	}
+}
+
+func TestDecodeReaderStopsAfterValue(t *testing.T) {
+	r := bytes.NewReader([]byte("l1:ae4:rest"))
+	v, n, e := DecodeReader(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(v, []any{"a"}) || n != 5 || r.Len() != 6 {
+		t.Errorf("DecodeReader = %#v, %d bytes, %d left; want [a], 5 bytes, 6 left", v, n, r.Len())
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		"i42e", "i-0e", "4:spam", "l4:spami42ee", "d3:bar4:spam3:fooi42ee",
+		"d3:fooi1e3:bari2ee", "5:abc", "li1e", "d1:ad1:bli1eeee",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		v, e := Decode(input)
+		if e != nil {
+			return
+		}
+		// the decoder only accepts canonical bencode, so encoding gives the input back
+		encoded, e := Encode(v)
+		if e != nil {
+			t.Fatalf("Encode(%#v): %v", v, e)
+		}
+		if !bytes.Equal(encoded, input) {
+			t.Fatalf("Decode(%q) encodes to %q", input, encoded)
+		}
+	})
+}
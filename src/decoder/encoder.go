@@ -1,68 +1,211 @@
 package decoder
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"reflect"
 	"slices"
 	"strconv"
 )
 
-func Encode(m map[string]any) ([]byte, error) {
-    return encode_dict(m)
+// UnsupportedTypeError is returned when Marshal finds a value it cannot encode.
+type UnsupportedTypeError struct {
+	Type reflect.Type
 }
-func encode_dict(m map[string]any) ([]byte, error) {
-	word := []byte{}
-	keys := get_keys(m)
-	for _, key := range keys {
-		value := m[key]
-		k_len := fmt.Sprintf("%d", len(key))
-
-		word = append(word, []byte(k_len)...)
-		word = append(word, []byte(key)...) // len:word
-
-		switch value.(type) {
-		case int:
-			num, _ := value.(int)
-			encoded := encode_int(num)
-			word = append(word, []byte(encoded)...)
-		case []byte:
-			s, _ := value.([]byte)
-			length := []byte(string(len(s)) + ":")
-			encoded := []byte{}
-			encoded = append(encoded, length...)
-			encoded = append(encoded, value.([]byte)...)
-
-			word = append(word, encoded...)
-		case string:
-			s, _ := value.(string)
-			encoded := fmt.Sprintf("%d:%s", len(s), s)
-			word = append(word, []byte(encoded)...)
-
-		case map[string]any:
-			res, _ := encode_dict(value.(map[string]any))
-			word = append(word, res...)
-
-		default:
-			return nil, fmt.Errorf("Error encoding")
 
+func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "bencode: cannot encode nil value"
+	}
+	return "bencode: unsupported type " + e.Type.String()
+}
+
+/*
+Marshaler is implemented by types that encode themselves. The returned
+bytes must be exactly one valid bencoded value.
+*/
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+var marshalerType = reflect.TypeFor[Marshaler]()
+
+// writer is what the encoder needs, both bytes.Buffer and bufio.Writer have it.
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// Encoder writes bencoded values to a stream.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+/*
+Encode writes the encoding of v to the stream. If v cannot be encoded
+part of it may have been written already.
+*/
+func (enc *Encoder) Encode(v any) error {
+	if e := encodeValue(enc.w, reflect.ValueOf(v)); e != nil {
+		return e
+	}
+	return enc.w.Flush()
+}
+
+// Encode returns the encoding of v, such as the values returned by Decode.
+func Encode(v any) ([]byte, error) {
+	return Marshal(v)
+}
+
+/*
+Marshal returns the bencoding of v. Structs are encoded as dictionaries
+using the same `bencode` tags as Unmarshal, []byte and string as strings,
+integers of any width and bools as integers, other slices and arrays as
+lists and maps with string keys as dictionaries. Keys are written sorted
+by their raw bytes, so the output is canonical.
+*/
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if e := encodeValue(&buf, reflect.ValueOf(v)); e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeValue(buf writer, v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedTypeError{}
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+	if v.Type().Implements(marshalerType) && !(v.Kind() == reflect.Pointer && v.IsNil()) {
+		return encodeMarshaler(buf, v.Interface().(Marshaler))
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return encodeMarshaler(buf, v.Addr().Interface().(Marshaler))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedTypeError{Type: v.Type()}
+		}
+		return encodeValue(buf, v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.Write(encode_int(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString("i" + strconv.FormatUint(v.Uint(), 10) + "e")
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.String:
+		encode_string(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			encode_string(buf, string(b))
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := range v.Len() {
+			if e := encodeValue(buf, v.Index(i)); e != nil {
+				return e
+			}
 		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{Type: v.Type()}
+		}
+		return encode_map(buf, v)
+	case reflect.Struct:
+		return encode_struct(buf, v)
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+func encodeMarshaler(buf writer, m Marshaler) error {
+	encoded, e := m.MarshalBencode()
+	if e != nil {
+		return e
+	}
+	if _, e := Decode(encoded); e != nil {
+		return fmt.Errorf("bencode: %T.MarshalBencode returned invalid bencode: %w", m, e)
+	}
+	buf.Write(encoded)
+	return nil
+}
 
+func encode_map(buf writer, v reflect.Value) error {
+	keys := get_keys(v)
+	buf.WriteByte('d')
+	for _, key := range keys {
+		encode_string(buf, key)
+		value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if e := encodeValue(buf, value); e != nil {
+			return fmt.Errorf("key %q: %w", key, e)
+		}
 	}
-	return word, nil
+	buf.WriteByte('e')
+	return nil
+}
 
+func encode_struct(buf writer, v reflect.Value) error {
+	buf.WriteByte('d')
+	prev := ""
+	for i, f := range cachedFields(v.Type()).list {
+		if i > 0 && f.name == prev {
+			return fmt.Errorf("bencode: duplicate key %q in %s", f.name, v.Type())
+		}
+		prev = f.name
+		value := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(value) {
+			continue
+		}
+		encode_string(buf, f.name)
+		if e := encodeValue(buf, value); e != nil {
+			return fmt.Errorf("field %q: %w", f.name, e)
+		}
+	}
+	buf.WriteByte('e')
+	return nil
 }
 
-func get_keys(m map[string]any) []string {
+// get_keys returns the keys of a map sorted by their raw bytes.
+func get_keys(m reflect.Value) []string {
 	keys := []string{}
-	for k, _ := range m {
-		keys = append(keys, k)
+	for _, k := range m.MapKeys() {
+		keys = append(keys, k.String())
 	}
 	slices.Sort(keys)
 	return keys
 }
 
-func encode_int(num int) []byte {
-	encoded := "i" + strconv.Itoa(num) + "e"
-	return []byte(encoded)
+func encode_string(buf writer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
 }
 
-
+func encode_int(num int64) []byte {
+	encoded := "i" + strconv.FormatInt(num, 10) + "e"
+	return []byte(encoded)
+}
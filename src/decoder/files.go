@@ -0,0 +1,186 @@
+package decoder
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File is an entry of the files list of a multi file torrent.
+type File struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Md5sum string   `bencode:"md5sum,omitempty"`
+	Attr   string   `bencode:"attr,omitempty"`
+}
+
+/*
+FileEntry places a file of the torrent in the concatenated torrent data.
+Path starts with Info.Name for multi file torrents.
+*/
+type FileEntry struct {
+	Path   []string
+	Length int
+	Offset int
+	Attr   string
+}
+
+// IsPadding reports whether the file is a BEP 47 padding file.
+func (f FileEntry) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// RelPath returns the path of the file relative to the download directory.
+func (f FileEntry) RelPath() string {
+	return filepath.Join(f.Path...)
+}
+
+// Layout is the list of files of a torrent in the order their data is stored.
+type Layout []FileEntry
+
+// FileSpan is the part of a single file covered by a range of torrent data.
+type FileSpan struct {
+	File       int // index in the Layout
+	FileOffset int
+	Length     int
+}
+
+func (i Info) IsMultiFile() bool {
+	return len(i.Files) > 0
+}
+
+// TotalLength returns the size of all the data of the torrent.
+func (i Info) TotalLength() int {
+	total := 0
+	switch {
+	case i.IsMultiFile():
+		for _, f := range i.Files {
+			total += f.Length
+		}
+	case i.Length > 0:
+		total = i.Length
+	case i.IsV2():
+		files, _ := i.V2Files()
+		for _, f := range files {
+			total += f.Length
+		}
+	}
+	return total
+}
+
+func (i Info) NumPieces() int {
+	if i.PieceLength <= 0 {
+		return 0
+	}
+	return (i.TotalLength() + i.PieceLength - 1) / i.PieceLength
+}
+
+// PieceSize returns the size of piece index, the last one may be shorter.
+func (i Info) PieceSize(index int) int {
+	if index == i.NumPieces()-1 {
+		return i.TotalLength() - index*i.PieceLength
+	}
+	return i.PieceLength
+}
+
+// PieceHash returns the SHA-1 of piece index from pieces, nil if there is none.
+func (i Info) PieceHash(index int) []byte {
+	if index < 0 || (index+1)*sha1.Size > len(i.Pieces) {
+		return nil
+	}
+	return i.Pieces[index*sha1.Size : (index+1)*sha1.Size]
+}
+
+// VerifyPiece tells if data is piece index, checking it against its v1 hash.
+func (i Info) VerifyPiece(index int, data []byte) bool {
+	expected := i.PieceHash(index)
+	if expected == nil || len(data) != i.PieceSize(index) {
+		return false
+	}
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], expected)
+}
+
+// Layout returns the files of the torrent with their offsets.
+func (i Info) Layout() Layout {
+	if !i.IsMultiFile() {
+		return Layout{{Path: []string{i.Name}, Length: i.Length}}
+	}
+	layout := make(Layout, len(i.Files))
+	offset := 0
+	for n, f := range i.Files {
+		path := append([]string{i.Name}, f.Path...)
+		layout[n] = FileEntry{Path: path, Length: f.Length, Offset: offset, Attr: f.Attr}
+		offset += f.Length
+	}
+	return layout
+}
+
+/*
+Spans maps length bytes of torrent data starting at offset to the files
+holding them. Empty files never appear in the result.
+*/
+func (l Layout) Spans(offset, length int) []FileSpan {
+	spans := []FileSpan{}
+	// first file ending after offset
+	n := sort.Search(len(l), func(i int) bool {
+		return l[i].Offset+l[i].Length > offset
+	})
+	for ; n < len(l) && length > 0; n++ {
+		f := l[n]
+		if f.Length == 0 {
+			continue
+		}
+		fileOffset := offset - f.Offset
+		size := min(f.Length-fileOffset, length)
+		spans = append(spans, FileSpan{File: n, FileOffset: fileOffset, Length: size})
+		offset += size
+		length -= size
+	}
+	return spans
+}
+
+// validateV1 checks the v1 fields of the info dictionary that later code relies on.
+func (i Info) validateV1() error {
+	if i.PieceLength <= 0 {
+		return errors.New("invalid piece length")
+	}
+	if i.Length != 0 && i.IsMultiFile() {
+		return errors.New("info has both length and files")
+	}
+	if !i.IsMultiFile() && i.Length <= 0 {
+		return errors.New("info has neither length nor files")
+	}
+	if e := validPathComponent(i.Name); e != nil {
+		return fmt.Errorf("name: %w", e)
+	}
+	for n, f := range i.Files {
+		if f.Length < 0 {
+			return fmt.Errorf("file %d: negative length", n)
+		}
+		if len(f.Path) == 0 {
+			return fmt.Errorf("file %d: empty path", n)
+		}
+		for _, c := range f.Path {
+			if e := validPathComponent(c); e != nil {
+				return fmt.Errorf("file %d: %w", n, e)
+			}
+		}
+	}
+	if len(i.Pieces) != 20*i.NumPieces() {
+		return fmt.Errorf("expected %d piece hashes, got %d bytes", i.NumPieces(), len(i.Pieces))
+	}
+	return nil
+}
+
+// validPathComponent rejects names that would escape the download directory.
+func validPathComponent(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid path component %q", name)
+	}
+	return nil
+}
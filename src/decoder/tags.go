@@ -0,0 +1,79 @@
+package decoder
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes how a struct field maps to a dictionary key.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+type structFields struct {
+	list   []field // sorted by key, the order they are encoded in
+	byName map[string]field
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+/*
+cachedFields returns the bencode keys of struct type t. A field tagged
+`bencode:"name,omitempty"` uses name as key and is left out when empty,
+a field tagged `bencode:"-"` is ignored and untagged exported fields use
+the field name.
+*/
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	fields := &structFields{byName: make(map[string]field)}
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		}
+		fields.list = append(fields.list, f)
+		fields.byName[name] = f
+	}
+	sort.Slice(fields.list, func(i, j int) bool {
+		return fields.list[i].name < fields.list[j].name
+	})
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.(*structFields)
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	case reflect.Struct:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+package decoder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+/*
+UnmarshalTypeError is returned when a bencoded value cannot be stored in
+the Go value it is being decoded into.
+*/
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+/*
+UnmarshalerError is returned when the UnmarshalBencode method of a value
+fails. Path locates the value, as in "info.files[2].path", Err is the error
+of the method.
+*/
+type UnmarshalerError struct {
+	Path   string
+	Type   reflect.Type
+	Offset int64
+	Err    error
+}
+
+func (e *UnmarshalerError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "value"
+	}
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d: %v", path, e.Type, e.Offset, e.Err)
+}
+
+func (e *UnmarshalerError) Unwrap() error {
+	return e.Err
+}
+
+/*
+Unmarshal decodes data, which must hold exactly one bencoded value, into
+the value pointed to by v. Struct fields are matched by their `bencode`
+tag, or by field name when untagged. Keys without a matching field are
+skipped.
+*/
+func Unmarshal(data []byte, v any) error {
+	r := bytes.NewReader(data)
+	d := NewDecoder(r)
+	e := d.DecodeInto(v)
+	if e == io.EOF {
+		return &SyntaxError{Offset: 0, Err: ErrUnexpectedEOF}
+	}
+	if e != nil {
+		return e
+	}
+	if r.Len() > 0 {
+		return &SyntaxError{Offset: d.Offset(), Err: ErrTrailingData}
+	}
+	return nil
+}
+
+// DecodeInto reads the next value from the stream and stores it in v.
+func (d *Decoder) DecodeInto(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: DecodeInto needs a non-nil pointer, got %T", v)
+	}
+	c, e := d.first()
+	if e != nil {
+		return e
+	}
+	return d.decodeValue(c, rv.Elem())
+}
+
+func kindName(c byte) string {
+	switch {
+	case c == 'i':
+		return "integer"
+	case c == 'l':
+		return "list"
+	case c == 'd':
+		return "dictionary"
+	}
+	return "string"
+}
+
+func (d *Decoder) typeError(c byte, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: kindName(c), Type: t, Offset: d.offset - 1}
+}
+
+/*
+RawMessage is a raw bencoded value. Unmarshal stores the exact bytes of the
+value in it and Marshal writes them back unchanged.
+*/
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeFor[RawMessage]()
+
+/*
+Unmarshaler is implemented by types that decode their own values. The
+method receives the raw encoding of the value.
+*/
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+var unmarshalerType = reflect.TypeFor[Unmarshaler]()
+
+// decodeValue decodes the value starting with the already read byte c into v.
+func (d *Decoder) decodeValue(c byte, v reflect.Value) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(c, v.Elem())
+	}
+	if v.Type() == rawMessageType {
+		raw, e := d.raw(c)
+		if e != nil {
+			return e
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		start := d.offset - 1
+		raw, e := d.raw(c)
+		if e != nil {
+			return e
+		}
+		if e := v.Addr().Interface().(Unmarshaler).UnmarshalBencode(raw); e != nil {
+			return &UnmarshalerError{Path: d.fieldPath(), Type: v.Type(), Offset: start, Err: e}
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, e := d.value(c)
+		if e != nil {
+			return e
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	}
+
+	switch {
+	case c == 'i':
+		return d.decodeInt(v)
+	case c >= '0' && c <= '9':
+		return d.decodeString(c, v)
+	case c == 'l':
+		return d.decodeList(v)
+	case c == 'd':
+		return d.decodeDict(v)
+	}
+	return d.syntaxError(ErrInvalidByte)
+}
+
+func (d *Decoder) decodeInt(v reflect.Value) error {
+	start := d.offset - 1
+	n, e := d.integer()
+	if e != nil {
+		return e
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(int64(n)) {
+			return &SyntaxError{Offset: start, Err: ErrIntOverflow}
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return &SyntaxError{Offset: start, Err: ErrIntOverflow}
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		return &UnmarshalTypeError{Value: "integer", Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeString(c byte, v reflect.Value) error {
+	start := d.offset - 1
+	s, e := d.str(c)
+	if e != nil {
+		return e
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte(s))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s):
+		reflect.Copy(v, reflect.ValueOf([]byte(s)))
+	default:
+		return &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeList(v reflect.Value) error {
+	if v.Kind() != reflect.Slice {
+		return d.typeError('l', v.Type())
+	}
+	if e := d.enter(); e != nil {
+		return e
+	}
+	list := reflect.MakeSlice(v.Type(), 0, 0)
+	for {
+		c, e := d.readByte()
+		if e != nil {
+			return e
+		}
+		if c == 'e' {
+			d.depth--
+			v.Set(list)
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		d.path = append(d.path, fmt.Sprintf("[%d]", list.Len()))
+		if e := d.decodeValue(c, elem); e != nil {
+			return e
+		}
+		d.path = d.path[:len(d.path)-1]
+		list = reflect.Append(list, elem)
+	}
+}
+
+func (d *Decoder) decodeDict(v reflect.Value) error {
+	var fields map[string]field
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type()).byName
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return d.typeError('d', v.Type())
+	}
+	if e := d.enter(); e != nil {
+		return e
+	}
+
+	prev := ""
+	for hasPrev := false; ; hasPrev = true {
+		key, done, e := d.dictKey(&prev, hasPrev)
+		if e != nil {
+			return e
+		}
+		if done {
+			d.depth--
+			return nil
+		}
+		c, e := d.readByte()
+		if e != nil {
+			return e
+		}
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.path = append(d.path, key)
+			if e := d.decodeValue(c, elem); e != nil {
+				return e
+			}
+			d.path = d.path[:len(d.path)-1]
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			continue
+		}
+		f, ok := fields[key]
+		if !ok {
+			// unknown key, decode and drop it
+			if _, e := d.value(c); e != nil {
+				return e
+			}
+			continue
+		}
+		d.path = append(d.path, key)
+		if e := d.decodeValue(c, v.Field(f.index)); e != nil {
+			return e
+		}
+		d.path = d.path[:len(d.path)-1]
+	}
+}
+
+// fieldPath returns the path of the value being decoded, list indexes attached to their list.
+func (d *Decoder) fieldPath() string {
+	path := ""
+	for _, part := range d.path {
+		if path != "" && !strings.HasPrefix(part, "[") {
+			path += "."
+		}
+		path += part
+	}
+	return path
+}
@@ -0,0 +1,30 @@
+package decoder
+
+import (
+	"errors"
+	"testing"
+)
+
+var errBadPort = errors.New("bad port")
+
+type port int
+
+func (p *port) UnmarshalBencode(data []byte) error {
+	return errBadPort
+}
+
+func TestUnmarshalerErrorPath(t *testing.T) {
+	var v struct {
+		Peers []struct {
+			Port port `bencode:"port"`
+		} `bencode:"peers"`
+	}
+	e := Unmarshal([]byte("d5:peersld4:porti1eed4:porti2eeee"), &v)
+	var unmarshalerErr *UnmarshalerError
+	if !errors.As(e, &unmarshalerErr) || !errors.Is(e, errBadPort) {
+		t.Fatalf("Unmarshal = %v, want an UnmarshalerError wrapping %v", e, errBadPort)
+	}
+	if unmarshalerErr.Path != "peers[0].port" || unmarshalerErr.Offset != 16 {
+		t.Errorf("error at %q offset %d, want peers[0].port offset 16", unmarshalerErr.Path, unmarshalerErr.Offset)
+	}
+}
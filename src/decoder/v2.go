@@ -0,0 +1,242 @@
+package decoder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Blocks hashed into the leaves of the BEP 52 merkle trees.
+const merkleBlockSize = 16 * 1024
+
+/*
+V2File is a file of the file tree of a BitTorrent v2 torrent. PiecesRoot
+is the root of the merkle tree of the file and is empty for empty files.
+*/
+type V2File struct {
+	Path       []string
+	Length     int
+	PiecesRoot []byte
+}
+
+func (i Info) IsV1() bool {
+	return i.Length > 0 || len(i.Files) > 0 || len(i.Pieces) > 0
+}
+
+func (i Info) IsV2() bool {
+	return i.MetaVersion == 2
+}
+
+// IsHybrid reports whether the torrent carries both v1 and v2 metadata.
+func (i Info) IsHybrid() bool {
+	return i.IsV1() && i.IsV2()
+}
+
+/*
+V2Files walks the file tree and returns its files in tree order, that is
+sorted by path. Paths do not include Info.Name.
+*/
+func (i Info) V2Files() ([]V2File, error) {
+	files := []V2File{}
+	e := walkFileTree(i.FileTree, nil, &files)
+	return files, e
+}
+
+func walkFileTree(node map[string]any, path []string, files *[]V2File) error {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		child, ok := node[name].(map[string]any)
+		if !ok {
+			return fmt.Errorf("file tree entry %q is not a dictionary", name)
+		}
+		if e := validPathComponent(name); e != nil {
+			return e
+		}
+		childPath := append(slices.Clone(path), name)
+
+		leaf, isFile := child[""]
+		if !isFile {
+			if e := walkFileTree(child, childPath, files); e != nil {
+				return e
+			}
+			continue
+		}
+		if len(child) != 1 {
+			return fmt.Errorf("file %q also has children", name)
+		}
+		attrs, ok := leaf.(map[string]any)
+		if !ok {
+			return fmt.Errorf("file %q: invalid attributes", name)
+		}
+		length, ok := attrs["length"].(int)
+		if !ok || length < 0 {
+			return fmt.Errorf("file %q: invalid length", name)
+		}
+		f := V2File{Path: childPath, Length: length}
+		if length > 0 {
+			root, ok := attrs["pieces root"].(string)
+			if !ok || len(root) != sha256.Size {
+				return fmt.Errorf("file %q: invalid pieces root", name)
+			}
+			f.PiecesRoot = []byte(root)
+		}
+		*files = append(*files, f)
+	}
+	return nil
+}
+
+// InfoHashV2 returns the SHA-256 of the raw info dictionary.
+func (m MetaInfo) InfoHashV2() []byte {
+	raw := m.InfoBytes
+	if len(raw) == 0 {
+		raw, _ = Marshal(m.Info)
+	}
+	hash := sha256.Sum256(raw)
+	return hash[:]
+}
+
+/*
+PeerInfoHash returns the 20 byte info hash used with trackers and in the
+peer handshake: the v1 hash when the torrent has v1 metadata, otherwise
+the truncated v2 hash.
+*/
+func (m MetaInfo) PeerInfoHash() []byte {
+	if m.Info.IsV1() {
+		return m.InfoHash()
+	}
+	return m.InfoHashV2()[:20]
+}
+
+// validateV2 checks the piece length and the file tree of a v2 torrent.
+func (i Info) validateV2() error {
+	if i.PieceLength < merkleBlockSize || i.PieceLength&(i.PieceLength-1) != 0 {
+		return errors.New("v2 piece length must be a power of two of at least 16 KiB")
+	}
+	files, e := i.V2Files()
+	if e != nil {
+		return e
+	}
+	if len(files) == 0 {
+		return errors.New("empty file tree")
+	}
+	return nil
+}
+
+/*
+validatePieceLayers checks the piece layers of the files larger than a
+piece, which must all have one when required.
+*/
+func (m MetaInfo) validatePieceLayers(required bool) error {
+	pieceLength := m.Info.PieceLength
+	files, e := m.Info.V2Files()
+	if e != nil {
+		return e
+	}
+	for _, f := range files {
+		if f.Length <= pieceLength {
+			continue
+		}
+		layer, ok := m.PieceLayers[string(f.PiecesRoot)]
+		if !ok && !required {
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("missing piece layer for %v", f.Path)
+		}
+		numPieces := (f.Length + pieceLength - 1) / pieceLength
+		if len(layer) != numPieces*sha256.Size {
+			return fmt.Errorf("piece layer for %v has wrong size", f.Path)
+		}
+		if !bytes.Equal(PieceLayerRoot(layer, pieceLength), f.PiecesRoot) {
+			return fmt.Errorf("piece layer for %v does not match its pieces root", f.Path)
+		}
+	}
+	return nil
+}
+
+/*
+MerkleRoot computes the root of a BEP 52 merkle tree whose lowest layer is
+hashes. The layer is padded up to a power of two with pad, the hash of an
+empty subtree at that height.
+*/
+func MerkleRoot(hashes [][]byte, pad []byte) []byte {
+	if len(hashes) == 0 {
+		return pad
+	}
+	width := 1
+	for width < len(hashes) {
+		width *= 2
+	}
+	layer := make([][]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+func hashPair(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// padHash returns the root of a tree of zero leaves covering size bytes.
+func padHash(size int) []byte {
+	pad := make([]byte, sha256.Size)
+	for covered := merkleBlockSize; covered < size; covered *= 2 {
+		pad = hashPair(pad, pad)
+	}
+	return pad
+}
+
+// PieceLayerRoot computes the pieces root of a file from its piece layer.
+func PieceLayerRoot(layer []byte, pieceLength int) []byte {
+	hashes := make([][]byte, 0, len(layer)/sha256.Size)
+	for i := 0; i+sha256.Size <= len(layer); i += sha256.Size {
+		hashes = append(hashes, layer[i:i+sha256.Size])
+	}
+	return MerkleRoot(hashes, padHash(pieceLength))
+}
+
+/*
+MerkleBlockHashes returns the leaf hashes of data, one SHA-256 per 16 KiB
+block. The merkle root of a file is MerkleRoot(MerkleBlockHashes(data),
+zero hash).
+*/
+func MerkleBlockHashes(data []byte) [][]byte {
+	hashes := [][]byte{}
+	for start := 0; start < len(data); start += merkleBlockSize {
+		end := min(start+merkleBlockSize, len(data))
+		h := sha256.Sum256(data[start:end])
+		hashes = append(hashes, h[:])
+	}
+	return hashes
+}
+
+/*
+PieceHashV2 returns the hash stored in the piece layer for a piece. The
+last piece of a file is padded with zero leaves up to a full piece.
+*/
+func PieceHashV2(piece []byte, pieceLength int) []byte {
+	hashes := MerkleBlockHashes(piece)
+	for len(hashes) < pieceLength/merkleBlockSize {
+		hashes = append(hashes, make([]byte, sha256.Size))
+	}
+	return MerkleRoot(hashes, make([]byte, sha256.Size))
+}
@@ -0,0 +1,50 @@
+package decoder
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPieceLayersFromInfoBytes rebuilds torrents from their info dictionary, as a magnet link does.
+func TestPieceLayersFromInfoBytes(t *testing.T) {
+	content := make([]byte, 3*16*1024+10)
+	rand.Read(content)
+	path := filepath.Join(t.TempDir(), "content")
+	if e := os.WriteFile(path, content, 0o644); e != nil {
+		t.Fatal(e)
+	}
+	for _, c := range []struct {
+		version TorrentVersion
+		opens   bool
+	}{
+		{TorrentHybrid, true},
+		// the layers of v2 only torrents are needed to verify pieces
+		{TorrentV2, false},
+	} {
+		created, e := CreateTorrent(path, CreateOptions{PieceLength: 16 * 1024, Version: c.version})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if _, e := ParseMetaInfo(mustMarshal(t, created)); e != nil {
+			t.Fatalf("version %v with piece layers: %v", c.version, e)
+		}
+		rebuilt, e := MetaInfoFromInfoBytes(created.InfoBytes, "")
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, e = ParseMetaInfo(mustMarshal(t, rebuilt))
+		if (e == nil) != c.opens {
+			t.Errorf("version %v without piece layers: ParseMetaInfo = %v", c.version, e)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	content, e := Marshal(v)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return content
+}
@@ -0,0 +1,665 @@
+package download
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"bittorrent/src/seed"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// MaxPeers is the number of connections kept open, 0 uses 30
+	MaxPeers int
+	// RequestTimeout drops a peer that sends no block for this long while we wait for some, 0 uses 30 seconds
+	RequestTimeout time.Duration
+	// StallTimeout ends the download when no piece completes for this long, 0 uses 2 minutes
+	StallTimeout time.Duration
+	// IdleTimeout drops a peer that chokes us or has nothing we need for this long while others wait to be dialed, 0 uses 1 minute
+	IdleTimeout time.Duration
+	// RetryAfter is the wait before dialing again a peer that failed, 0 uses 1 minute
+	RetryAfter time.Duration
+	// Picker chooses the pieces to start, nil uses RarestFirst
+	Picker PiecePicker
+}
+
+// ErrStalled is returned by Run when no piece completed for StallTimeout.
+var ErrStalled = errors.New("no peer sent a piece for too long")
+
+/*
+maxHashFailures is the number of pieces that did not verify after which a
+peer that took part in all of them is dropped for good.
+*/
+const maxHashFailures = 3
+
+type blockState int
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// pieceProgress is a piece with blocks requested or received.
+type pieceProgress struct {
+	index    int
+	data     []byte
+	blocks   []blockState
+	owners   [][]*peer // who each requested block was asked to, several in endgame
+	sources  []string  // who each received block came from
+	received int
+	// failed holds the peers that sent data of this piece when it did not verify
+	failed map[string]bool
+}
+
+// remaining returns the number of blocks not received yet.
+func (pp *pieceProgress) remaining() int {
+	return len(pp.blocks) - pp.received
+}
+
+/*
+Downloader downloads a torrent from many peers at once. Each connection
+runs on its own goroutine and takes blocks of the pieces it has, finishing
+pieces already started before starting new ones. Peers that fail or stop
+sending are dropped and replaced by others from the tracker.
+*/
+type Downloader struct {
+	// OnPiece is called with every complete piece, one piece at a time
+	OnPiece func(index int, data []byte) error
+	// OnHave is called once a piece passed to OnPiece is ours and can be shared
+	OnHave func(index int)
+	// Share, when set with Choker, is served to the peers we download from
+	Share  *seed.Torrent
+	Choker *seed.Choker
+	// pieceMu serializes OnPiece and the update of the pieces we have
+	pieceMu sync.Mutex
+
+	info     decoder.Info
+	infoHash []byte
+	session  *protocol.TrackerSession
+	config   Config
+
+	swarm *protocol.Availability
+
+	mu       sync.Mutex
+	have     protocol.Bitfield
+	left     int64
+	progress map[int]*pieceProgress
+	peers    map[string]*peer
+	// candidates are addresses to dial, tried remembers when each one was last dialed
+	candidates []protocol.IP
+	tried      map[string]time.Time
+	// hashFails counts the pieces each peer took part in that did not verify
+	hashFails map[string]int
+	banned    map[string]bool
+	err       error
+	// lastPiece is when the last piece completed, or when Run started
+	lastPiece time.Time
+
+	// wake the manager when a slot frees, a peer arrives or the download ends
+	wake chan struct{}
+	done chan struct{}
+}
+
+/*
+New creates the downloader of a torrent. session, when not nil, gets the
+transfer counters and provides more peers with every re-announce.
+*/
+func New(metaInfo decoder.MetaInfo, session *protocol.TrackerSession, config Config) *Downloader {
+	if config.MaxPeers <= 0 {
+		config.MaxPeers = 30
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = 30 * time.Second
+	}
+	if config.StallTimeout <= 0 {
+		config.StallTimeout = 2 * time.Minute
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = time.Minute
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = time.Minute
+	}
+	if config.Picker == nil {
+		config.Picker = RarestFirst{}
+	}
+	numPieces := metaInfo.Info.NumPieces()
+	return &Downloader{
+		info:      metaInfo.Info,
+		infoHash:  metaInfo.PeerInfoHash(),
+		session:   session,
+		config:    config,
+		swarm:     protocol.NewAvailability(numPieces),
+		have:      protocol.NewBitfield(numPieces),
+		left:      int64(metaInfo.Info.TotalLength()),
+		progress:  make(map[int]*pieceProgress),
+		peers:     make(map[string]*peer),
+		tried:     make(map[string]time.Time),
+		hashFails: make(map[string]int),
+		banned:    make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// Progress returns the number of pieces downloaded and the total.
+func (d *Downloader) Progress() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.have.Count(), d.info.NumPieces()
+}
+
+// NumPeers returns the number of connected peers.
+func (d *Downloader) NumPeers() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.peers)
+}
+
+/*
+Run downloads the torrent from peers and the ones the tracker sends later,
+and returns once every piece was passed to OnPiece. It fails with
+ErrStalled if no piece completes for StallTimeout, whether no peer can be
+reached or the connected ones send nothing.
+*/
+func (d *Downloader) Run(peers []protocol.IP) error {
+	d.AddPeers(peers)
+	if d.complete() {
+		return nil
+	}
+
+	var trackerPeers <-chan []protocol.IP
+	if d.session != nil {
+		trackerPeers = d.session.Peers()
+	}
+	retry := time.NewTicker(d.config.RetryAfter)
+	defer retry.Stop()
+	d.mu.Lock()
+	d.lastPiece = time.Now()
+	d.mu.Unlock()
+
+	for {
+		d.connectPeers()
+
+		d.mu.Lock()
+		lastPiece, err := d.lastPiece, d.err
+		d.mu.Unlock()
+		if err != nil || d.complete() {
+			d.closePeers()
+			return err
+		}
+		stallIn := d.config.StallTimeout - time.Since(lastPiece)
+		if stallIn <= 0 {
+			d.closePeers()
+			return ErrStalled
+		}
+
+		select {
+		case <-d.done:
+		case <-d.wake:
+		case <-retry.C:
+		case <-time.After(stallIn):
+		case peers := <-trackerPeers:
+			d.AddPeers(peers)
+		}
+	}
+}
+
+// AddPeers adds addresses to dial, the ones already known are ignored.
+func (d *Downloader) AddPeers(peers []protocol.IP) {
+	d.mu.Lock()
+	for _, p := range peers {
+		if _, known := d.tried[p.String()]; known {
+			continue
+		}
+		d.tried[p.String()] = time.Time{}
+		d.candidates = append(d.candidates, p)
+	}
+	d.mu.Unlock()
+	d.signal()
+}
+
+// waiting tells if there are peers to dial that a slot could go to.
+func (d *Downloader) waiting() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.candidates) > 0
+}
+
+func (d *Downloader) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Downloader) complete() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+connectPeers dials candidates until MaxPeers connections are open. Peers
+that failed go back to the candidates once RetryAfter has passed.
+*/
+func (d *Downloader) connectPeers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.candidates) == 0 {
+		for addr, last := range d.tried {
+			if _, connected := d.peers[addr]; !connected && !d.banned[addr] && !last.IsZero() && time.Since(last) > d.config.RetryAfter {
+				if ip, e := protocol.IPFromStr(addr); e == nil {
+					d.candidates = append(d.candidates, ip)
+				}
+			}
+		}
+	}
+	for len(d.peers) < d.config.MaxPeers && len(d.candidates) > 0 {
+		ip := d.candidates[0]
+		d.candidates = d.candidates[1:]
+		addr := ip.String()
+		if _, connected := d.peers[addr]; connected {
+			continue
+		}
+		d.tried[addr] = time.Now()
+		p := &peer{d: d, addr: addr, kick: make(chan struct{}, 1)}
+		d.peers[addr] = p
+		go p.run()
+	}
+}
+
+func (d *Downloader) closePeers() {
+	d.mu.Lock()
+	peers := []*peer{}
+	for _, p := range d.peers {
+		peers = append(peers, p)
+	}
+	d.mu.Unlock()
+	for _, p := range peers {
+		p.close()
+	}
+}
+
+// removePeer frees the slot of a peer that ended and gives its blocks back.
+func (d *Downloader) removePeer(p *peer, e error) {
+	d.mu.Lock()
+	if d.peers[p.addr] == p {
+		delete(d.peers, p.addr)
+	}
+	d.mu.Unlock()
+	d.giveBack(p, nil)
+	if e != nil && !d.complete() {
+		log.Printf("Peer %s: %v\n", p.addr, e)
+	}
+	d.signal()
+}
+
+// giveBack releases blocks of p and wakes the other peers so they take them.
+func (d *Downloader) giveBack(p *peer, requests []protocol.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.releaseBlocks(p, requests)
+	d.kickPeers(p)
+}
+
+// kickPeers wakes every peer but p to ask for more blocks. d.mu must be held.
+func (d *Downloader) kickPeers(p *peer) {
+	for _, other := range d.peers {
+		if other == p {
+			continue
+		}
+		select {
+		case other.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+releaseBlocks drops p from the blocks requested from it, only the given
+ones when requests is not nil. Blocks nobody else was asked for are missing
+again. d.mu must be held.
+*/
+func (d *Downloader) releaseBlocks(p *peer, requests []protocol.Request) {
+	for _, pp := range d.progress {
+		for i, owners := range pp.owners {
+			if pp.blocks[i] != blockRequested || !slices.Contains(owners, p) {
+				continue
+			}
+			if requests != nil && !containsBlock(requests, pp.index, i) {
+				continue
+			}
+			pp.owners[i] = slices.DeleteFunc(owners, func(owner *peer) bool { return owner == p })
+			if len(pp.owners[i]) == 0 {
+				pp.blocks[i] = blockMissing
+			}
+		}
+	}
+}
+
+func containsBlock(requests []protocol.Request, index int, block int) bool {
+	for _, r := range requests {
+		if int(r.Index) == index && int(r.Begin) == block*protocol.BlockSize {
+			return true
+		}
+	}
+	return false
+}
+
+// needs tells if the peer has a piece we still need.
+func (d *Downloader) needs(peerPieces protocol.Bitfield) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, index := range peerPieces.Indices() {
+		if index < d.info.NumPieces() && !d.have.Has(index) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+assign returns up to n new requests for the peer: the missing blocks of
+pieces already started first, the ones closest to done first, then blocks
+of pieces chosen by the picker. Pieces that did not verify are asked to
+other peers when there are some. In endgame, when every block left is
+requested, the peer is also asked for blocks other peers have not sent yet.
+*/
+func (d *Downloader) assign(p *peer, peerPieces protocol.Bitfield, n int) []protocol.Request {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.endgame() {
+		defer func() {
+			if d.endgame() {
+				// idle peers may now duplicate the last blocks
+				d.kickPeers(p)
+			}
+		}()
+	}
+	started := []*pieceProgress{}
+	for _, pp := range d.progress {
+		if peerPieces.Has(pp.index) && !d.avoids(p, pp) {
+			started = append(started, pp)
+		}
+	}
+	sort.Slice(started, func(i, j int) bool {
+		left, right := started[i].remaining(), started[j].remaining()
+		if left != right {
+			return left < right
+		}
+		return started[i].index < started[j].index
+	})
+	requests := []protocol.Request{}
+	for _, pp := range started {
+		if len(requests) >= n {
+			return requests
+		}
+		requests = d.takeBlocks(p, pp, requests, n)
+	}
+	if len(requests) >= n {
+		return requests
+	}
+	if d.endgame() {
+		for _, pp := range started {
+			requests = d.duplicateBlocks(p, pp, requests, n)
+		}
+		return requests
+	}
+
+	candidates := []int{}
+	for _, index := range peerPieces.Indices() {
+		if _, inProgress := d.progress[index]; index < d.info.NumPieces() && !d.have.Has(index) && !inProgress {
+			candidates = append(candidates, index)
+		}
+	}
+	state := PickState{Have: d.have, Availability: d.swarm.Counts()}
+	for len(requests) < n && len(candidates) > 0 {
+		index := d.config.Picker.Pick(candidates, state)
+		i := slices.Index(candidates, index)
+		if i < 0 {
+			break
+		}
+		candidates = slices.Delete(candidates, i, i+1)
+		pp := d.startPiece(index)
+		requests = d.takeBlocks(p, pp, requests, n)
+	}
+	return requests
+}
+
+/*
+avoids tells if p sent bad data for pp while other peers that did not may
+have it. With no one else the piece is asked to the same peers again.
+d.mu must be held.
+*/
+func (d *Downloader) avoids(p *peer, pp *pieceProgress) bool {
+	return pp.failed[p.addr] && d.swarm.Count(pp.index) > len(pp.failed)
+}
+
+func (d *Downloader) startPiece(index int) *pieceProgress {
+	size := d.info.PieceSize(index)
+	numBlocks := (size + protocol.BlockSize - 1) / protocol.BlockSize
+	pp := &pieceProgress{
+		index:   index,
+		data:    make([]byte, size),
+		blocks:  make([]blockState, numBlocks),
+		owners:  make([][]*peer, numBlocks),
+		sources: make([]string, numBlocks),
+		failed:  make(map[string]bool),
+	}
+	d.progress[index] = pp
+	return pp
+}
+
+// takeBlocks appends requests for missing blocks of pp until there are n.
+func (d *Downloader) takeBlocks(p *peer, pp *pieceProgress, requests []protocol.Request, n int) []protocol.Request {
+	for i, state := range pp.blocks {
+		if len(requests) >= n {
+			break
+		}
+		if state != blockMissing {
+			continue
+		}
+		pp.blocks[i] = blockRequested
+		pp.owners[i] = []*peer{p}
+		requests = append(requests, pp.request(i))
+	}
+	return requests
+}
+
+/*
+endgame tells if every block we still need is requested, so that only the
+peers holding the last ones decide when the download ends. d.mu must be
+held.
+*/
+func (d *Downloader) endgame() bool {
+	if len(d.progress) < d.info.NumPieces()-d.have.Count() {
+		return false
+	}
+	for _, pp := range d.progress {
+		if slices.Contains(pp.blocks, blockMissing) {
+			return false
+		}
+	}
+	return true
+}
+
+// duplicateBlocks appends requests for blocks of pp requested from other peers until there are n.
+func (d *Downloader) duplicateBlocks(p *peer, pp *pieceProgress, requests []protocol.Request, n int) []protocol.Request {
+	for i, state := range pp.blocks {
+		if len(requests) >= n {
+			break
+		}
+		if state != blockRequested || slices.Contains(pp.owners[i], p) {
+			continue
+		}
+		pp.owners[i] = append(pp.owners[i], p)
+		requests = append(requests, pp.request(i))
+	}
+	return requests
+}
+
+// request returns the request of block i.
+func (pp *pieceProgress) request(i int) protocol.Request {
+	begin := i * protocol.BlockSize
+	return protocol.Request{
+		Index:  uint32(pp.index),
+		Begin:  uint32(begin),
+		Length: uint32(min(protocol.BlockSize, len(pp.data)-begin)),
+	}
+}
+
+/*
+blockReceived stores a block p sent and cancels the copies asked to other
+peers in endgame. When it completes its piece the piece is checked against
+its hash, then passed to OnPiece and announced to every peer. A piece that
+does not verify is downloaded again.
+*/
+func (d *Downloader) blockReceived(p *peer, block protocol.Piece) error {
+	d.mu.Lock()
+	pp := d.progress[int(block.Index)]
+	i := int(block.Begin) / protocol.BlockSize
+	if pp == nil || pp.blocks[i] == blockReceived {
+		d.mu.Unlock()
+		return nil
+	}
+	copy(pp.data[block.Begin:], block.Block)
+	duplicates := pp.owners[i]
+	pp.blocks[i] = blockReceived
+	pp.owners[i] = nil
+	pp.sources[i] = p.addr
+	pp.received++
+	complete := pp.received == len(pp.blocks)
+	if complete {
+		delete(d.progress, pp.index)
+	}
+	d.mu.Unlock()
+
+	for _, owner := range duplicates {
+		if owner != p {
+			owner.cancel(pp.request(i))
+		}
+	}
+	if !complete {
+		return nil
+	}
+
+	if !d.info.VerifyPiece(pp.index, pp.data) {
+		return d.hashFailed(p, pp)
+	}
+
+	d.pieceMu.Lock()
+	defer d.pieceMu.Unlock()
+	if d.OnPiece != nil {
+		if e := d.OnPiece(pp.index, pp.data); e != nil {
+			d.fail(e)
+			return e
+		}
+	}
+	d.pieceDone(pp.index, len(pp.data))
+	return nil
+}
+
+/*
+hashFailed drops the data of a piece that did not verify and starts it
+again, away from the peers that sent it when possible. It returns an error
+when p is one of them and sent too many bad pieces.
+*/
+func (d *Downloader) hashFailed(p *peer, pp *pieceProgress) error {
+	d.mu.Lock()
+	senders := map[string]bool{}
+	for _, addr := range pp.sources {
+		senders[addr] = true
+	}
+	log.Printf("Piece %d did not verify, sent by %d peers\n", pp.index, len(senders))
+
+	retry := d.startPiece(pp.index)
+	for addr := range pp.failed {
+		retry.failed[addr] = true
+	}
+	var e error
+	drop := []*peer{}
+	for addr := range senders {
+		retry.failed[addr] = true
+		d.hashFails[addr]++
+		if d.hashFails[addr] < maxHashFailures {
+			continue
+		}
+		d.banned[addr] = true
+		if addr == p.addr {
+			e = fmt.Errorf("sent %d pieces that did not verify", d.hashFails[addr])
+		} else if other, connected := d.peers[addr]; connected {
+			drop = append(drop, other)
+		}
+	}
+	d.mu.Unlock()
+	for _, other := range drop {
+		other.close()
+	}
+	return e
+}
+
+// pieceDone records a piece as ours and sends HAVE to the peers.
+func (d *Downloader) pieceDone(index int, size int) {
+	d.mu.Lock()
+	d.have.Set(index)
+	d.left -= int64(size)
+	d.lastPiece = time.Now()
+	left := d.left
+	complete := d.have.Count() == d.info.NumPieces()
+	peers := []*peer{}
+	for _, p := range d.peers {
+		peers = append(peers, p)
+	}
+	d.mu.Unlock()
+
+	if d.session != nil {
+		d.session.AddDownloaded(int64(size))
+		d.session.SetLeft(left)
+	}
+	for _, p := range peers {
+		p.sendHave(index)
+	}
+	if d.OnHave != nil {
+		d.OnHave(index)
+	}
+	if complete {
+		d.finish()
+	}
+}
+
+// Have returns a copy of the pieces downloaded and verified.
+func (d *Downloader) Have() protocol.Bitfield {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(protocol.Bitfield{}, d.have...)
+}
+
+// fail ends the download with an error that no peer can fix, such as a write error.
+func (d *Downloader) fail(e error) {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = e
+	}
+	d.mu.Unlock()
+	d.finish()
+}
+
+func (d *Downloader) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.done:
+	default:
+		close(d.done)
+	}
+}
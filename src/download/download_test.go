@@ -0,0 +1,154 @@
+package download
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"bittorrent/src/seed"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTorrent creates a torrent of random content with 16 KiB pieces.
+func testTorrent(t *testing.T, size int) (decoder.MetaInfo, []byte) {
+	content := make([]byte, size)
+	rand.Read(content)
+	path := filepath.Join(t.TempDir(), "content")
+	if e := os.WriteFile(path, content, 0o644); e != nil {
+		t.Fatal(e)
+	}
+	metaInfo, e := decoder.CreateTorrent(path, decoder.CreateOptions{PieceLength: 16 * 1024})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return metaInfo, content
+}
+
+// listen runs serve on every connection to a new loopback listener.
+func listen(t *testing.T, serve func(net.Conn)) protocol.IP {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			con, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go serve(con)
+		}
+	}()
+	ip, e := protocol.IPFromStr(l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return ip
+}
+
+// seeder serves content to every peer, unchoking them all.
+func seeder(t *testing.T, metaInfo decoder.MetaInfo, content []byte) protocol.IP {
+	choker := seed.NewChoker(10)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go choker.Run(done)
+	server := seed.NewServer(choker)
+	server.Add(&seed.Torrent{
+		Info:     metaInfo.Info,
+		InfoHash: metaInfo.PeerInfoHash(),
+		ReadBlock: func(index int, begin int, data []byte) error {
+			copy(data, content[index*metaInfo.Info.PieceLength+begin:])
+			return nil
+		},
+	})
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+	ip, e := protocol.IPFromStr(l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return ip
+}
+
+// choking is a peer that has every piece but never unchokes us.
+func choking(t *testing.T, metaInfo decoder.MetaInfo) protocol.IP {
+	return listen(t, func(con net.Conn) {
+		defer con.Close()
+		conn := protocol.NewConnection(con)
+		_, e := conn.AcceptHandshake(func(infoHash []byte) (protocol.PeerHandshake, error) {
+			return protocol.NewHandshake(infoHash), nil
+		})
+		if e != nil {
+			return
+		}
+		conn.WriteMessage(protocol.Bitfield(protocol.FullBitfield(metaInfo.Info.NumPieces())))
+		io.Copy(io.Discard, con)
+	})
+}
+
+// collect returns an OnPiece storing the pieces and the buffer they go to.
+func collect(metaInfo decoder.MetaInfo) (func(int, []byte) error, func() []byte) {
+	var mu sync.Mutex
+	data := make([]byte, metaInfo.Info.TotalLength())
+	onPiece := func(index int, piece []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		copy(data[index*metaInfo.Info.PieceLength:], piece)
+		return nil
+	}
+	return onPiece, func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return data
+	}
+}
+
+func TestRunReplacesChokingPeer(t *testing.T) {
+	metaInfo, content := testTorrent(t, 5*16*1024+100)
+	d := New(metaInfo, nil, Config{MaxPeers: 1, IdleTimeout: 300 * time.Millisecond, StallTimeout: 10 * time.Second})
+	onPiece, data := collect(metaInfo)
+	d.OnPiece = onPiece
+
+	result := make(chan error, 1)
+	go func() { result <- d.Run([]protocol.IP{choking(t, metaInfo), seeder(t, metaInfo, content)}) }()
+	select {
+	case e := <-result:
+		if e != nil {
+			t.Fatal(e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run still blocked on the choking peer")
+	}
+	if !bytes.Equal(data(), content) {
+		t.Error("downloaded content differs")
+	}
+}
+
+func TestRunStallsWithoutPieces(t *testing.T) {
+	metaInfo, _ := testTorrent(t, 2*16*1024)
+	d := New(metaInfo, nil, Config{StallTimeout: 500 * time.Millisecond})
+	d.OnPiece, _ = collect(metaInfo)
+
+	result := make(chan error, 1)
+	go func() { result <- d.Run([]protocol.IP{choking(t, metaInfo)}) }()
+	select {
+	case e := <-result:
+		if !errors.Is(e, ErrStalled) {
+			t.Fatalf("Run = %v, want %v", e, ErrStalled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stall with a peer that never unchokes")
+	}
+}
@@ -0,0 +1,215 @@
+package download
+
+import (
+	"bittorrent/src/protocol"
+	"bittorrent/src/seed"
+	"errors"
+	"sync"
+	"time"
+)
+
+// HandshakeTimeout bounds the connection and handshake with a peer.
+var HandshakeTimeout = 20 * time.Second
+
+// peer is a connection of the downloader, driven by its own goroutine.
+type peer struct {
+	d    *Downloader
+	addr string
+	// kick wakes the peer when blocks it may take were given back
+	kick chan struct{}
+
+	mu   sync.Mutex
+	conn *protocol.Connection
+	// lastBlock is when the last block arrived, or when we started waiting for one
+	lastBlock time.Time
+	// lastUseful is when the peer last unchoked us with pieces we need, or when it connected
+	lastUseful time.Time
+	closed     bool
+}
+
+func (p *peer) run() {
+	e := p.download()
+	p.close()
+	p.d.removePeer(p, e)
+}
+
+func (p *peer) connect() (*protocol.Connection, error) {
+	conn, e := protocol.CreateConnection(p.addr)
+	if e != nil {
+		return nil, e
+	}
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if _, e := conn.Handshake(protocol.NewHandshake(p.d.infoHash)); e != nil {
+		conn.Close()
+		return nil, e
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *peer) download() error {
+	conn, e := p.connect()
+	if e != nil {
+		return e
+	}
+	p.mu.Lock()
+	p.conn = conn
+	p.lastUseful = time.Now()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		conn.Close()
+		return nil
+	}
+
+	conn.TrackPieces(p.d.info.NumPieces(), p.d.swarm)
+	var upload *seed.Upload
+	if p.d.Share != nil && p.d.Choker != nil {
+		upload = seed.NewUpload(p.d.Share, conn)
+		if e := upload.Start(); e != nil {
+			return e
+		}
+		defer upload.Close()
+		p.d.Choker.Add(upload)
+		defer p.d.Choker.Remove(upload)
+	}
+	events := conn.Start()
+	timeout := time.NewTicker(min(p.d.config.RequestTimeout, p.d.config.IdleTimeout) / 4)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-p.d.done:
+			return nil
+		case <-p.kick:
+		case <-timeout.C:
+			if p.stalled() {
+				return errors.New("peer stopped sending blocks")
+			}
+			if p.idle() && p.d.waiting() {
+				return errors.New("peer chokes us or has nothing we need, trying another one")
+			}
+			continue
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if upload != nil {
+				if e := upload.Handle(event); e != nil {
+					return e
+				}
+			}
+			switch event.Type {
+			case protocol.PeerClosed:
+				return event.Err
+			case protocol.PeerInterested, protocol.PeerNotInterested:
+				if upload != nil {
+					p.d.Choker.Interest()
+				}
+			case protocol.PeerChoked:
+				// the blocks it held can be taken by other peers meanwhile
+				pending := conn.Pending()
+				for _, r := range pending {
+					conn.CancelRequest(r)
+				}
+				p.d.giveBack(p, pending)
+			case protocol.RequestRejected:
+				p.d.giveBack(p, event.Requests)
+			case protocol.BlockReceived:
+				p.mu.Lock()
+				p.lastBlock = time.Now()
+				p.mu.Unlock()
+				if e := p.d.blockReceived(p, event.Message.(protocol.Piece)); e != nil {
+					return e
+				}
+			}
+		}
+		if e := p.requestMore(conn); e != nil {
+			return e
+		}
+	}
+}
+
+/*
+requestMore declares our interest and keeps twice the request window
+queued, so the window never waits on the downloader.
+*/
+func (p *peer) requestMore(conn *protocol.Connection) error {
+	peerPieces := conn.PeerPieces()
+	if !p.d.needs(peerPieces) {
+		return conn.SetInterested(false)
+	}
+	if e := conn.SetInterested(true); e != nil {
+		return e
+	}
+	state := conn.State()
+	if state.PeerChoking {
+		return nil
+	}
+	p.mu.Lock()
+	p.lastUseful = time.Now()
+	p.mu.Unlock()
+	pending := len(conn.Pending())
+	want := 2*conn.RequestWindow() - pending
+	if want <= 0 {
+		return nil
+	}
+	requests := p.d.assign(p, peerPieces, want)
+	if len(requests) == 0 {
+		return nil
+	}
+	if pending == 0 {
+		p.mu.Lock()
+		p.lastBlock = time.Now()
+		p.mu.Unlock()
+	}
+	return conn.QueueRequests(requests...)
+}
+
+// stalled tells if requests have been waiting for longer than RequestTimeout.
+func (p *peer) stalled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil || len(p.conn.Pending()) == 0 || p.conn.State().PeerChoking {
+		return false
+	}
+	return time.Since(p.lastBlock) > p.d.config.RequestTimeout
+}
+
+// idle tells if the peer choked us or had nothing we need for longer than IdleTimeout.
+func (p *peer) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn != nil && time.Since(p.lastUseful) > p.d.config.IdleTimeout
+}
+
+func (p *peer) sendHave(index int) {
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn != nil {
+		conn.SendHave(uint32(index))
+	}
+}
+
+// cancel drops a request sent to the peer, with a CANCEL if it already went out.
+func (p *peer) cancel(request protocol.Request) {
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn != nil {
+		conn.CancelRequest(request)
+	}
+}
+
+func (p *peer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
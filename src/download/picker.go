@@ -0,0 +1,135 @@
+package download
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"math/rand/v2"
+)
+
+/*
+PiecePicker chooses the next piece to start. The downloader first gives a
+peer the missing blocks of pieces already started, the ones closest to
+done first, so peers cooperate on finishing them; the picker is asked only
+when the peer can take more.
+*/
+type PiecePicker interface {
+	// Pick returns one of candidates, the pieces the peer has that nobody started, or -1 for none.
+	Pick(candidates []int, state PickState) int
+}
+
+// PickState is what a picker knows of the download.
+type PickState struct {
+	// Have holds the pieces downloaded and verified
+	Have protocol.Bitfield
+	// Availability is the number of connected peers that have each piece
+	Availability []int
+}
+
+// RarestFirst picks the piece the fewest peers have, at random between equals.
+type RarestFirst struct{}
+
+func (RarestFirst) Pick(candidates []int, state PickState) int {
+	best, ties := -1, 0
+	for _, index := range candidates {
+		count := state.Availability[index]
+		switch {
+		case best < 0 || count < state.Availability[best]:
+			best, ties = index, 1
+		case count == state.Availability[best]:
+			// keep each of the ties with the same chance
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = index
+			}
+		}
+	}
+	return best
+}
+
+/*
+RandomFirst picks random pieces until Pieces are downloaded, so we soon
+have something to trade, then leaves the choice to Then.
+*/
+type RandomFirst struct {
+	Pieces int
+	Then   PiecePicker
+}
+
+func (p RandomFirst) Pick(candidates []int, state PickState) int {
+	if state.Have.Count() >= p.Pieces && p.Then != nil {
+		return p.Then.Pick(candidates, state)
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// Sequential picks the lowest piece, for playing a file while it downloads.
+type Sequential struct{}
+
+func (Sequential) Pick(candidates []int, state PickState) int {
+	best := -1
+	for _, index := range candidates {
+		if best < 0 || index < best {
+			best = index
+		}
+	}
+	return best
+}
+
+/*
+Priority picks among the pieces of highest weight, using Then between them.
+Pieces without a weight have weight 1.
+*/
+type Priority struct {
+	Weights []int
+	Then    PiecePicker
+}
+
+func (p Priority) Pick(candidates []int, state PickState) int {
+	top := []int{}
+	topWeight := 0
+	for _, index := range candidates {
+		weight := p.weight(index)
+		if len(top) == 0 || weight > topWeight {
+			top, topWeight = []int{index}, weight
+		} else if weight == topWeight {
+			top = append(top, index)
+		}
+	}
+	if p.Then == nil {
+		return Sequential{}.Pick(top, state)
+	}
+	return p.Then.Pick(top, state)
+}
+
+func (p Priority) weight(index int) int {
+	if index < len(p.Weights) {
+		return p.Weights[index]
+	}
+	return 1
+}
+
+/*
+FileWeights returns the weights of the pieces for Priority from weights of
+files, keyed by their path in the torrent. A piece shared by files gets the
+highest of their weights, files not listed have weight 1.
+*/
+func FileWeights(info decoder.Info, weights map[string]int) []int {
+	pieces := make([]int, info.NumPieces())
+	for _, f := range info.Layout() {
+		if f.Length == 0 || f.IsPadding() {
+			continue
+		}
+		weight, ok := weights[f.RelPath()]
+		if !ok {
+			weight = 1
+		}
+		first, last := f.Offset/info.PieceLength, (f.Offset+f.Length-1)/info.PieceLength
+		for index := first; index <= last; index++ {
+			pieces[index] = max(pieces[index], weight)
+		}
+	}
+	return pieces
+}
@@ -2,39 +2,61 @@ package main
 
 import (
 	"bittorrent/src/decoder"
+	"bittorrent/src/download"
 	"bittorrent/src/protocol"
+	"bittorrent/src/seed"
+	"bittorrent/src/storage"
+	"bittorrent/src/tracker"
 	"bufio"
-	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
-
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: bittorrent <command> [arguments]")
+		os.Exit(1)
+	}
 	command := os.Args[1]
-	arg2 := os.Args[2]
 
 	switch command {
 	case "decode":
-		cmd_decode([]byte(arg2))
+		cmd_decode([]byte(arg(2)))
 	case "info":
-		cmd_info(arg2)
+		cmd_info(arg(2))
 	case "peer":
-		cmd_peer(arg2)
+		cmd_peer(arg(2))
 	case "handshake":
-		arg3 := os.Args[3]
-		cmd_handshake(arg2, arg3)
+		cmd_handshake(arg(2), arg(3))
 	case "download_piece":
-		arg3 := os.Args[3]
-		arg4, _ := strconv.Atoi(os.Args[4])
-		cmdDownloadPiece(arg2, arg3, arg4)
+		index, _ := strconv.Atoi(arg(4))
+		cmdDownloadPiece(arg(2), arg(3), index)
 	case "download":
-		arg3 := os.Args[3]
-		cmdDownload(arg2, arg3)
+		cmdDownload(os.Args[2:])
+	case "create":
+		cmdCreate(os.Args[2:])
+	case "magnet":
+		output := ""
+		if len(os.Args) > 3 {
+			output = os.Args[3]
+		}
+		cmdMagnet(arg(2), output)
+	case "scrape":
+		cmdScrape(os.Args[2:])
+	case "tracker-serve":
+		cmdTrackerServe(os.Args[2:])
+	case "seed":
+		cmdSeed(os.Args[2:])
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		os.Exit(1)
@@ -42,6 +64,15 @@ func main() {
 
 }
 
+// arg returns the positional argument i of the command, which must be there.
+func arg(i int) string {
+	if len(os.Args) <= i {
+		fmt.Printf("Missing argument %d for %s\n", i-1, os.Args[1])
+		os.Exit(1)
+	}
+	return os.Args[i]
+}
+
 func cmd_decode(bencode []byte) {
 	res, e := decoder.Decode(bencode)
 	if e != nil {
@@ -136,82 +167,477 @@ func cmdDownloadPiece(path string, file string, index int) {
 
 }
 
-func cmdDownload(path string, file string) {
+/*
+cmdDownload downloads a torrent into a directory, sharing the pieces it has
+with the peers meanwhile:
+download [-port 6881] [-slots 4] [-storage sparse|preallocate|mmap] [-picker rarest|random|sequential] [-random-first n] [-priority path=weight] <output> <torrent>
+*/
+func cmdDownload(args []string) {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	pickerName := flags.String("picker", "rarest", "order pieces are downloaded in: rarest, random or sequential")
+	randomFirst := flags.Int("random-first", 4, "pieces picked at random before using the picker")
+	var priorities listFlag
+	flags.Var(&priorities, "priority", "path=weight, pieces of files with a higher weight first, may be repeated")
+	port := flags.Int("port", 6881, "TCP port peers connect to, 0 to not accept peers")
+	storageName := flags.String("storage", "sparse", "how files are written: sparse, preallocate or mmap")
+	slots := flags.Int("slots", 4, "peers we upload to at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: download [flags] <output> <torrent>")
+		os.Exit(1)
+	}
+	path, file := flags.Arg(0), flags.Arg(1)
 
 	//obtain metainfo and hash
-	metaInfo, hash, _ := decoder.MetaInfoFromFile(file)
-	//get peers
-	peers, _ := protocol.GetPeers(metaInfo)
+	metaInfo, hash, e := decoder.MetaInfoFromFile(file)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	if len(metaInfo.Info.Pieces) == 0 {
+		// pieces are verified and stored with the v1 hashes only
+		fmt.Println("Error: the torrent has no v1 pieces, v2 only torrents cannot be downloaded")
+		os.Exit(1)
+	}
+	picker, e := piecePicker(*pickerName, *randomFirst, priorities, metaInfo.Info)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	var listener net.Listener
+	if *port != 0 {
+		if listener, e = net.Listen("tcp", fmt.Sprintf(":%d", *port)); e != nil {
+			log.Println("Not accepting peers:", e)
+		}
+	}
+	//get peers, the session keeps the tracker updated until we are done
+	tracker := protocol.NewTrackerTiers(metaInfo.AnnounceTiers())
+	session := protocol.NewTrackerSession(tracker, hash, int64(metaInfo.Info.TotalLength()), *port)
+	resp, e := session.Start()
+	if e != nil {
+		log.Panicln(e)
+	}
+	defer session.Stop()
+	if len(resp.Peers) == 0 {
+		log.Panicln("No peers found")
+	}
 
-	//create connection
-	// TODO: check if peers work if more than 1
-	con, e := protocol.CreateConnection(peers[0].String())
-	log.Println("Connecting to", peers[0].String())
+	store, e := openStorage(*storageName, path, metaInfo.Info)
 	if e != nil {
 		log.Panicln(e)
 	}
-	handshake := protocol.NewHandshake(hash)
-	peerId, _ := con.Handshake(handshake)
-	log.Printf("Handshake made, peer_id: %s.\n", peerId)
+	defer store.Close()
 
-	piecelist := pieces_hashes(metaInfo.Info.Pieces)
+	d := download.New(metaInfo, session, download.Config{Picker: picker})
+	d.OnPiece = func(index int, piece []byte) error {
+		if e := store.WriteAt(index, 0, piece); e != nil {
+			return e
+		}
+		if e := store.MarkComplete(index); e != nil {
+			return e
+		}
+		have, total := d.Progress()
+		fmt.Printf("\rDownloading pieces: %d/%d from %d peers...", have+1, total, d.NumPeers())
+		return nil
+	}
 
-	con.WaitResponse() // unchoke received or bitfield
-	_, e = con.SendInterested()         //send interested msg
+	// the pieces we have go to the peers we download from and the ones that connect to us
+	choker := seed.NewChoker(*slots)
+	done := make(chan struct{})
+	defer close(done)
+	go choker.Run(done)
+	d.Share = &seed.Torrent{
+		Info:      metaInfo.Info,
+		InfoHash:  metaInfo.PeerInfoHash(),
+		Have:      d.Have,
+		ReadBlock: store.ReadAt,
+		Session:   session,
+	}
+	d.Choker = choker
+	if listener != nil {
+		server := seed.NewServer(choker)
+		server.Add(d.Share)
+		d.OnHave = func(index int) { server.SendHave(d.Share.InfoHash, index) }
+		go server.Serve(listener)
+		defer listener.Close()
+	}
+
+	if e := d.Run(resp.Peers); e != nil {
+		fmt.Println()
+		log.Println("Download failed:", e)
+		session.Stop()
+		os.Exit(1)
+	}
+	fmt.Println()
+	log.Println("All pieces received")
+	if bad, e := storage.Verify(store, metaInfo.Info); e != nil || len(bad) > 0 {
+		log.Println("Downloaded files do not verify, bad pieces:", bad, e)
+		store.Close()
+		session.Stop()
+		os.Exit(1)
+	}
+	if e := session.Completed(); e != nil {
+		log.Println("Announce failed:", e)
+	}
+	log.Println("Torrent", metaInfo.Info.Name, "downloaded to", path)
+}
+
+// openStorage creates the storage the download flags ask for.
+func openStorage(name string, path string, info decoder.Info) (storage.Storage, error) {
+	switch name {
+	case "sparse":
+		return storage.NewFiles(path, info, storage.Sparse)
+	case "preallocate":
+		return storage.NewFiles(path, info, storage.Preallocate)
+	case "mmap":
+		return storage.NewMmap(path, info)
+	}
+	return nil, fmt.Errorf("unknown storage %q", name)
+}
+
+// piecePicker builds the picker the download flags ask for.
+func piecePicker(name string, randomFirst int, priorities []string, info decoder.Info) (download.PiecePicker, error) {
+	var picker download.PiecePicker
+	switch name {
+	case "rarest":
+		picker = download.RarestFirst{}
+	case "random":
+		picker = download.RandomFirst{Pieces: info.NumPieces()}
+	case "sequential":
+		picker = download.Sequential{}
+	default:
+		return nil, fmt.Errorf("unknown picker %q", name)
+	}
+	if randomFirst > 0 && name == "rarest" {
+		picker = download.RandomFirst{Pieces: randomFirst, Then: picker}
+	}
+	if len(priorities) > 0 {
+		weights := map[string]int{}
+		for _, priority := range priorities {
+			filePath, weight, found := strings.Cut(priority, "=")
+			n, e := strconv.Atoi(weight)
+			if !found || e != nil {
+				return nil, fmt.Errorf("invalid priority %q, expected path=weight", priority)
+			}
+			weights[filepath.Clean(filePath)] = n
+		}
+		picker = download.Priority{Weights: download.FileWeights(info, weights), Then: picker}
+	}
+	return picker, nil
+}
+
+/*
+cmdMagnet fetches the metadata of a magnet link from the swarm. It prints
+the torrent info, or saves it as a .torrent file when output is given.
+*/
+func cmdMagnet(uri string, output string) {
+	magnet, e := protocol.ParseMagnet(uri)
 	if e != nil {
-		log.Panicln(e)
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	metaInfo, e := protocol.ResolveMagnet(magnet)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	if output == "" {
+		print_info(metaInfo)
+		return
+	}
+	content, e := decoder.Marshal(metaInfo)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	// v2 only torrents need the piece layers, which are not part of the info dictionary
+	if _, e := decoder.ParseMetaInfo(content); e != nil {
+		fmt.Println("Error: the resolved torrent cannot be saved:", e)
+		os.Exit(1)
+	}
+	if e := os.WriteFile(output, content, 0644); e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	log.Println("Torrent saved to", output)
+}
+
+/*
+cmdScrape prints the seeders and leechers of each torrent. Torrents that
+share their first tracker are scraped in a single request, when that fails
+the other trackers of the torrent are tried one by one.
+*/
+func cmdScrape(files []string) {
+	metaInfos := []decoder.MetaInfo{}
+	groups := map[string][]int{}
+	trackers := []string{}
+	for _, file := range files {
+		metaInfo, _, e := decoder.MetaInfoFromFile(file)
+		if e != nil {
+			fmt.Println("Error:", e)
+			os.Exit(1)
+		}
+		tiers := metaInfo.AnnounceTiers()
+		if len(tiers) == 0 || len(tiers[0]) == 0 {
+			fmt.Printf("%s: torrent has no trackers\n", metaInfo.Info.Name)
+			continue
+		}
+		first := tiers[0][0]
+		if groups[first] == nil {
+			trackers = append(trackers, first)
+		}
+		groups[first] = append(groups[first], len(metaInfos))
+		metaInfos = append(metaInfos, metaInfo)
 	}
-	totalDownloaded := 0
-	piecesLeft := len(piecelist)
 
-	for piecesLeft > 0 {
-        fmt.Printf("\rDownloading pieces: %d/%d...",len(piecelist)-piecesLeft,len(piecelist))
+	failed := false
+	for _, tracker := range trackers {
+		group := groups[tracker]
+		hashes := [][]byte{}
+		for _, i := range group {
+			hashes = append(hashes, metaInfos[i].PeerInfoHash())
+		}
+		results, e := protocol.Scrape(tracker, hashes)
+		if e == nil {
+			for n, i := range group {
+				print_scrape(metaInfos[i], results[n])
+			}
+			continue
+		}
+		log.Printf("Tracker %s: %v\n", tracker, e)
+		for _, i := range group {
+			if !scrapeFallback(metaInfos[i], tracker) {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
 
-		msgType, content, _ := con.WaitResponse() //wait for Have to tell index
-		if msgType == protocol.HAVE {
-			indexAvailable := con.ManageResponse(msgType, content).(uint32)
-            //todo get piece data
-			_, _, e := con.DownloadPiece(int(indexAvailable), metaInfo.Info)
+// scrapeFallback scrapes a torrent through its trackers other than skip.
+func scrapeFallback(metaInfo decoder.MetaInfo, skip string) bool {
+	hashes := [][]byte{metaInfo.PeerInfoHash()}
+	for _, tier := range metaInfo.AnnounceTiers() {
+		for _, tracker := range tier {
+			if tracker == skip {
+				continue
+			}
+			results, e := protocol.Scrape(tracker, hashes)
 			if e != nil {
-				log.Panicln(e)
+				log.Printf("Tracker %s: %v\n", tracker, e)
+				continue
 			}
-            piecesLeft--
-			//log.Println("Piece", indexAvailable, "downloaded. Pieces remaining", piecesLeft)
-			_, e = con.SendHave(indexAvailable) //send we have received the piece
-		}else{
-            //log.Println("NO have, type",msgType.String())
-        }
+			print_scrape(metaInfo, results[0])
+			return true
+		}
+	}
+	fmt.Printf("%s: no tracker answered the scrape\n", metaInfo.Info.Name)
+	return false
+}
+
+func print_scrape(metaInfo decoder.MetaInfo, result protocol.ScrapeResult) {
+	fmt.Printf("%s: seeders %d, leechers %d, downloaded %d\n",
+		metaInfo.Info.Name, result.Complete, result.Incomplete, result.Downloaded)
+}
+
+/*
+cmdSeed shares a torrent whose files are complete in path, the directory it
+was downloaded to, until it is killed:
+seed [-port 6881] [-slots 4] <path> <torrent>
+*/
+func cmdSeed(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	port := flags.Int("port", 6881, "TCP port peers connect to")
+	slots := flags.Int("slots", 4, "peers we upload to at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: seed [flags] <path> <torrent>")
+		os.Exit(1)
+	}
+	path, file := flags.Arg(0), flags.Arg(1)
 
+	metaInfo, hash, e := decoder.MetaInfoFromFile(file)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	store, e := storage.OpenFiles(path, metaInfo.Info)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	defer store.Close()
+	if bad, e := storage.Verify(store, metaInfo.Info); e != nil || len(bad) > 0 {
+		fmt.Println("Error: files do not match the torrent, bad pieces:", bad, e)
+		os.Exit(1)
 	}
-    log.Println("All pieces received")
 
-	return
+	listener, e := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	tracker := protocol.NewTrackerTiers(metaInfo.AnnounceTiers())
+	session := protocol.NewTrackerSession(tracker, hash, 0, *port)
+	if _, e := session.Start(); e != nil {
+		log.Println("Announce failed:", e)
+	}
 
-	for i, p := range piecelist {
-		newFile, _ := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	choker := seed.NewChoker(*slots)
+	go choker.Run(nil)
+	server := seed.NewServer(choker)
+	server.Add(&seed.Torrent{
+		Info:      metaInfo.Info,
+		InfoHash:  metaInfo.PeerInfoHash(),
+		ReadBlock: store.ReadAt,
+		Session:   session,
+	})
+	log.Println("Seeding", metaInfo.Info.Name, "on port", *port)
+	e = server.Serve(listener)
+	session.Stop()
+	fmt.Println("Error:", e)
+	os.Exit(1)
+}
 
-		piece, size, e := con.DownloadPiece(i, metaInfo.Info)
-		totalDownloaded += size
-		if e != nil {
-			fmt.Printf("Error downloading piece: %v\n", e)
-			return
+/*
+cmdTrackerServe runs a tracker over HTTP and UDP until it is killed. Swarms
+are only kept in memory.
+*/
+func cmdTrackerServe(args []string) {
+	flags := flag.NewFlagSet("tracker-serve", flag.ExitOnError)
+	httpAddr := flags.String("http", ":6969", "HTTP listen address, empty to disable")
+	udpAddr := flags.String("udp", ":6969", "UDP listen address, empty to disable")
+	interval := flags.Duration("interval", 30*time.Minute, "announce interval sent to clients")
+	var allowed, passkeys listFlag
+	flags.Var(&allowed, "allow", "hex info hash the tracker accepts, may be repeated (default any)")
+	flags.Var(&passkeys, "passkey", "passkey accepted on /<passkey>/announce, may be repeated")
+	flags.Parse(args)
+
+	config := tracker.Config{Interval: *interval, Passkeys: passkeys}
+	for _, hash := range allowed {
+		decoded, e := hex.DecodeString(hash)
+		if e != nil || len(decoded) != 20 {
+			fmt.Println("Error: invalid info hash", hash)
+			os.Exit(1)
+		}
+		config.Allowed = append(config.Allowed, decoded)
+	}
+	t := tracker.New(config)
+	go func() {
+		for range time.Tick(time.Minute) {
+			t.Sweep()
 		}
+	}()
 
-		fmt.Printf("Piece %d downloaded: %d bytes. Remaining bytes: %d\n", i, len(piece), metaInfo.Info.Length-totalDownloaded)
-		sha := sha1.Sum(piece)
-		shaD := hex.EncodeToString(sha[:])
-		if p != shaD {
-			println("Error: downloaded piece", i, "hash is not the same as actual")
-			fmt.Printf("Expected:\n%s\nActual:\n%s\n", p, shaD)
-			return
+	errs := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, e := net.ListenPacket("udp", *udpAddr)
+		if e != nil {
+			fmt.Println("Error:", e)
+			os.Exit(1)
 		}
+		log.Println("Tracker listening on udp", conn.LocalAddr())
+		go func() { errs <- t.ServeUDP(conn) }()
+	}
+	if *httpAddr != "" {
+		log.Println("Tracker listening on http", *httpAddr)
+		go func() { errs <- http.ListenAndServe(*httpAddr, t) }()
+	}
+	if *udpAddr == "" && *httpAddr == "" {
+		fmt.Println("Error: nothing to listen on")
+		os.Exit(1)
+	}
+	fmt.Println("Error:", <-errs)
+	os.Exit(1)
+}
+
+// trackerTiers collects -a flags, each one a comma separated tier of trackers.
+type trackerTiers [][]string
+
+func (t *trackerTiers) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *trackerTiers) Set(value string) error {
+	*t = append(*t, strings.Split(value, ","))
+	return nil
+}
+
+// listFlag collects a flag that may be repeated.
+type listFlag []string
 
-		newFile.Write(piece)
-		newFile.Close()
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+/*
+cmdCreate writes a .torrent for a file or directory:
+create [-a trackers] [-w webseed] [-c comment] [-p] [-l piece length] [-v 1|2|hybrid] <path> <output>
+*/
+func cmdCreate(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	var tiers trackerTiers
+	var webSeeds listFlag
+	flags.Var(&tiers, "a", "comma separated tier of tracker URLs, repeat for more tiers")
+	flags.Var(&webSeeds, "w", "web seed URL, may be repeated")
+	comment := flags.String("c", "", "comment")
+	private := flags.Bool("p", false, "private torrent")
+	pieceLength := flags.Int("l", 0, "piece length in bytes, 0 picks one")
+	version := flags.String("v", "1", "metadata version: 1, 2 or hybrid")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: create [flags] <path> <output.torrent>")
+		flags.PrintDefaults()
+		os.Exit(1)
 	}
 
-	//println("File", metaInfo.Info.Name, "downloaded to", path)
+	opts := decoder.CreateOptions{
+		Comment:     *comment,
+		CreatedBy:   "bittorrent",
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		PieceLength: *pieceLength,
+	}
+	switch *version {
+	case "1":
+		opts.Version = decoder.TorrentV1
+	case "2":
+		opts.Version = decoder.TorrentV2
+	case "hybrid":
+		opts.Version = decoder.TorrentHybrid
+	default:
+		fmt.Printf("Unknown version: %s\n", *version)
+		os.Exit(1)
+	}
+	if len(tiers) > 0 {
+		opts.Announce = tiers[0][0]
+	}
+	if len(tiers) > 1 || (len(tiers) == 1 && len(tiers[0]) > 1) {
+		opts.AnnounceList = tiers
+	}
 
+	metaInfo, e := decoder.CreateTorrent(flags.Arg(0), opts)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	content, e := decoder.Marshal(metaInfo)
+	if e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	if e := os.WriteFile(flags.Arg(1), content, 0644); e != nil {
+		fmt.Println("Error:", e)
+		os.Exit(1)
+	}
+	log.Println("Torrent written to", flags.Arg(1))
 }
 
 func Marshall(content any) {
@@ -229,15 +655,31 @@ func pieces_hashes(pieces []byte) []string {
 
 }
 func print_info(metaInfo decoder.MetaInfo) {
-	hash, _ := decoder.CalculateInfoHash(metaInfo.Info)
 	fmt.Printf("Tracker URL: %s\n", metaInfo.Announce)
-	fmt.Printf("Length: %d\n", metaInfo.Info.Length)
-	fmt.Printf("Info Hash: %s\n", hash)
+	fmt.Printf("Length: %d\n", metaInfo.Info.TotalLength())
+	if metaInfo.Info.IsV1() {
+		fmt.Printf("Info Hash: %x\n", metaInfo.InfoHash())
+	}
+	if metaInfo.Info.IsV2() {
+		fmt.Printf("Info Hash v2: %x\n", metaInfo.InfoHashV2())
+	}
 	fmt.Printf("Piece Length: %d\n", metaInfo.Info.PieceLength)
 	fmt.Printf("Piece Hashes:\n")
 	list := pieces_hashes(metaInfo.Info.Pieces)
 	for _, l := range list {
 		println(l)
 	}
+	if metaInfo.Info.IsV2() && !metaInfo.Info.IsV1() {
+		files, _ := metaInfo.Info.V2Files()
+		fmt.Printf("Files:\n")
+		for _, f := range files {
+			fmt.Printf("%s (%d bytes) root %x\n", filepath.Join(f.Path...), f.Length, f.PiecesRoot)
+		}
+	} else if metaInfo.Info.IsMultiFile() {
+		fmt.Printf("Files:\n")
+		for _, f := range metaInfo.Info.Layout() {
+			fmt.Printf("%s (%d bytes)\n", f.RelPath(), f.Length)
+		}
+	}
 
 }
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// NewBitfield returns an empty bitfield for numPieces pieces.
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// FullBitfield returns a bitfield with all numPieces pieces set.
+func FullBitfield(numPieces int) Bitfield {
+	b := NewBitfield(numPieces)
+	for i := range numPieces {
+		b.Set(i)
+	}
+	return b
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+func (b Bitfield) Set(index int) {
+	if index >= 0 && index/8 < len(b) {
+		b[index/8] |= 0x80 >> (index % 8)
+	}
+}
+
+func (b Bitfield) Clear(index int) {
+	if index >= 0 && index/8 < len(b) {
+		b[index/8] &^= 0x80 >> (index % 8)
+	}
+}
+
+// Count returns the number of pieces set.
+func (b Bitfield) Count() int {
+	count := 0
+	for _, c := range b {
+		count += bits.OnesCount8(c)
+	}
+	return count
+}
+
+// Indices returns the pieces set, in order.
+func (b Bitfield) Indices() []int {
+	indices := []int{}
+	for i, c := range b {
+		// the highest bit set is the lowest piece
+		for ; c != 0; c &^= 0x80 >> bits.LeadingZeros8(c) {
+			indices = append(indices, i*8+bits.LeadingZeros8(c))
+		}
+	}
+	return indices
+}
+
+/*
+Validate checks that the bitfield has the size for numPieces pieces and
+that the spare bits at the end are cleared, as peers must send them.
+*/
+func (b Bitfield) Validate(numPieces int) error {
+	if len(b) != (numPieces+7)/8 {
+		return fmt.Errorf("%w: bitfield of %d bytes for %d pieces", ErrInvalidMessage, len(b), numPieces)
+	}
+	if numPieces%8 != 0 && b[len(b)-1]&(0xff>>(numPieces%8)) != 0 {
+		return fmt.Errorf("%w: bitfield spare bits are set", ErrInvalidMessage)
+	}
+	return nil
+}
+
+/*
+Availability counts how many connected peers have each piece. It is shared
+by the connections of a torrent, which add and remove their pieces.
+*/
+type Availability struct {
+	mu     sync.Mutex
+	counts []int
+}
+
+func NewAvailability(numPieces int) *Availability {
+	return &Availability{counts: make([]int, numPieces)}
+}
+
+// Count returns the number of peers that have the piece.
+func (a *Availability) Count(index int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if index < 0 || index >= len(a.counts) {
+		return 0
+	}
+	return a.counts[index]
+}
+
+// Counts returns a copy of the count of every piece.
+func (a *Availability) Counts() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]int{}, a.counts...)
+}
+
+func (a *Availability) add(b Bitfield, delta int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, index := range b.Indices() {
+		if index < len(a.counts) {
+			a.counts[index] += delta
+		}
+	}
+}
+
+// addPiece counts one more peer having the piece, for a HAVE.
+func (a *Availability) addPiece(index int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if index < len(a.counts) {
+		a.counts[index]++
+	}
+}
+
+/*
+peerPieces tracks the pieces the remote peer has, from its BITFIELD, HAVE,
+HAVE_ALL and HAVE_NONE messages, and keeps the swarm availability in sync.
+*/
+type peerPieces struct {
+	mu        sync.Mutex
+	numPieces int
+	have      Bitfield
+	swarm     *Availability
+}
+
+// update applies a message of the peer, only bad bitfields are an error.
+func (p *peerPieces) update(msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch msg := msg.(type) {
+	case Bitfield:
+		if e := msg.Validate(p.numPieces); e != nil {
+			return e
+		}
+		p.replace(append(Bitfield{}, msg...))
+	case HaveAll:
+		p.replace(FullBitfield(p.numPieces))
+	case HaveNone:
+		p.replace(NewBitfield(p.numPieces))
+	case Have:
+		index := int(msg.Index)
+		if index >= p.numPieces || p.have.Has(index) {
+			return nil
+		}
+		p.have.Set(index)
+		if p.swarm != nil {
+			p.swarm.addPiece(index)
+		}
+	}
+	return nil
+}
+
+func (p *peerPieces) replace(have Bitfield) {
+	if p.swarm != nil {
+		p.swarm.add(p.have, -1)
+		p.swarm.add(have, 1)
+	}
+	p.have = have
+}
+
+/*
+TrackPieces starts keeping the pieces of the peer, from the messages read
+after it. swarm, when not nil, gets the pieces of this peer added until
+the connection is closed.
+*/
+func (c *Connection) TrackPieces(numPieces int, swarm *Availability) {
+	c.pieces = &peerPieces{
+		numPieces: numPieces,
+		have:      NewBitfield(numPieces),
+		swarm:     swarm,
+	}
+}
+
+// PeerHas tells if the peer has announced the piece.
+func (c *Connection) PeerHas(index int) bool {
+	if c.pieces == nil {
+		return false
+	}
+	c.pieces.mu.Lock()
+	defer c.pieces.mu.Unlock()
+	return c.pieces.have.Has(index)
+}
+
+// PeerPieces returns a copy of the pieces the peer has.
+func (c *Connection) PeerPieces() Bitfield {
+	if c.pieces == nil {
+		return nil
+	}
+	c.pieces.mu.Lock()
+	defer c.pieces.mu.Unlock()
+	return append(Bitfield{}, c.pieces.have...)
+}
@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestBitfieldValidate(t *testing.T) {
+	cases := []struct {
+		bitfield  Bitfield
+		numPieces int
+		valid     bool
+	}{
+		{Bitfield{0xff}, 8, true},
+		{Bitfield{0xff, 0xe0}, 11, true},
+		{Bitfield{0xff, 0xf0}, 11, false}, // spare bit set
+		{Bitfield{0xff, 0x01}, 11, false},
+		{Bitfield{0xff}, 11, false},      // too short
+		{Bitfield{0xff, 0x00}, 8, false}, // too long
+		{Bitfield{}, 0, true},
+	}
+	for _, c := range cases {
+		e := c.bitfield.Validate(c.numPieces)
+		if c.valid && e != nil || !c.valid && !errors.Is(e, ErrInvalidMessage) {
+			t.Errorf("Validate(%08b, %d) = %v", c.bitfield, c.numPieces, e)
+		}
+	}
+}
+
+func TestBitfieldIndices(t *testing.T) {
+	cases := []struct {
+		bitfield Bitfield
+		want     []int
+	}{
+		{Bitfield{}, []int{}},
+		{Bitfield{0x00, 0x00}, []int{}},
+		{Bitfield{0x80}, []int{0}},
+		{Bitfield{0x01, 0x80}, []int{7, 8}},
+		{Bitfield{0xa5, 0x41}, []int{0, 2, 5, 7, 9, 15}},
+		{FullBitfield(10), []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	}
+	for _, c := range cases {
+		got := c.bitfield.Indices()
+		if !slices.Equal(got, c.want) {
+			t.Errorf("Indices(%08b) = %v, want %v", c.bitfield, got, c.want)
+		}
+		if len(got) != c.bitfield.Count() {
+			t.Errorf("Count(%08b) = %d, want %d", c.bitfield, c.bitfield.Count(), len(got))
+		}
+	}
+}
+
+func TestPeerPiecesUpdate(t *testing.T) {
+	cases := []struct {
+		name     string
+		messages []Message
+		want     []int
+	}{
+		{"bitfield", []Message{Bitfield{0xa0, 0x40}}, []int{0, 2, 9}},
+		{"have", []Message{Have{Index: 3}, Have{Index: 9}}, []int{3, 9}},
+		{"have twice", []Message{Have{Index: 3}, Have{Index: 3}}, []int{3}},
+		{"have out of range", []Message{Have{Index: 10}}, []int{}},
+		{"have after bitfield", []Message{Bitfield{0x80, 0x00}, Have{Index: 1}}, []int{0, 1}},
+		{"have all", []Message{Have{Index: 3}, HaveAll{}}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"have none", []Message{HaveAll{}, HaveNone{}}, []int{}},
+		{"bitfield replaces", []Message{HaveAll{}, Bitfield{0x00, 0x40}}, []int{9}},
+		{"other messages", []Message{Unchoke{}, Request{Index: 1}}, []int{}},
+	}
+	for _, c := range cases {
+		swarm := NewAvailability(10)
+		// another peer with pieces 0 and 1, whose counts must stay
+		other := &peerPieces{numPieces: 10, have: NewBitfield(10), swarm: swarm}
+		other.update(Bitfield{0xc0, 0x00})
+		p := &peerPieces{numPieces: 10, have: NewBitfield(10), swarm: swarm}
+		for _, msg := range c.messages {
+			if e := p.update(msg); e != nil {
+				t.Fatalf("%s: update(%#v): %v", c.name, msg, e)
+			}
+		}
+		if got := p.have.Indices(); !slices.Equal(got, c.want) {
+			t.Errorf("%s: peer has %v, want %v", c.name, got, c.want)
+		}
+		for index, count := range swarm.Counts() {
+			want := 0
+			if index < 2 {
+				want++
+			}
+			if slices.Contains(c.want, index) {
+				want++
+			}
+			if count != want {
+				t.Errorf("%s: availability of %d = %d, want %d", c.name, index, count, want)
+			}
+		}
+	}
+}
+
+func TestPeerPiecesBadBitfield(t *testing.T) {
+	swarm := NewAvailability(10)
+	p := &peerPieces{numPieces: 10, have: NewBitfield(10), swarm: swarm}
+	p.update(Have{Index: 4})
+	if e := p.update(Bitfield{0xff, 0xff}); !errors.Is(e, ErrInvalidMessage) {
+		t.Errorf("update with spare bits set = %v, want %v", e, ErrInvalidMessage)
+	}
+	// the pieces known before are kept
+	if !slices.Equal(p.have.Indices(), []int{4}) || swarm.Count(4) != 1 || swarm.Count(0) != 0 {
+		t.Errorf("peer has %v, counts %v after a bad bitfield", p.have.Indices(), swarm.Counts())
+	}
+}
+
+func TestCloseRemovesPieces(t *testing.T) {
+	swarm := NewAvailability(10)
+	conns := []*Connection{}
+	for range 2 {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		conn := NewConnection(local)
+		conn.TrackPieces(10, swarm)
+		conns = append(conns, conn)
+	}
+	conns[0].pieces.update(HaveAll{})
+	conns[1].pieces.update(Bitfield{0x80, 0x40})
+	if swarm.Count(0) != 2 || swarm.Count(1) != 1 || swarm.Count(9) != 2 {
+		t.Fatalf("counts %v", swarm.Counts())
+	}
+
+	conns[0].Close()
+	want := []int{1, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	if got := swarm.Counts(); !slices.Equal(got, want) {
+		t.Errorf("counts after Close %v, want %v", got, want)
+	}
+	// closing twice does not subtract again
+	conns[0].Close()
+	conns[1].Close()
+	if got := swarm.Counts(); !slices.Equal(got, make([]int, 10)) {
+		t.Errorf("counts after closing every connection %v", got)
+	}
+}
@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"bittorrent/src/decoder"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracker responses larger than this are not read.
+const maxResponseSize = 1 << 20
+
+// httpClient is used for announces and scrapes, a tracker that does not answer fails after its timeout.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// HTTPTracker announces to an http:// or https:// tracker.
+type HTTPTracker struct {
+	URL string
+
+	mu sync.Mutex
+	// trackerId is sent back on every announce once the tracker gave one
+	trackerId string
+}
+
+func (t *HTTPTracker) Announce(p AnnounceParams) (TrackerResp, error) {
+	params := url.Values{}
+	params.Add("info_hash", string(p.InfoHash))
+	params.Add("peer_id", p.PeerId)
+	params.Add("port", fmt.Sprint(p.Port))
+	params.Add("uploaded", fmt.Sprint(p.Uploaded))
+	params.Add("downloaded", fmt.Sprint(p.Downloaded))
+	params.Add("left", fmt.Sprint(p.Left))
+	params.Add("compact", "1")
+	if p.Event != EventNone {
+		params.Add("event", p.Event.String())
+	}
+	if p.NumWant > 0 {
+		params.Add("numwant", fmt.Sprint(p.NumWant))
+	}
+	if p.Key != 0 {
+		params.Add("key", fmt.Sprintf("%08x", p.Key))
+	}
+	t.mu.Lock()
+	trackerId := t.trackerId
+	t.mu.Unlock()
+	if p.TrackerId != "" {
+		trackerId = p.TrackerId
+	}
+	if trackerId != "" {
+		params.Add("trackerid", trackerId)
+	}
+	separator := "?"
+	if strings.Contains(t.URL, "?") {
+		separator = "&" // private trackers keep the passkey in the query
+	}
+	url := t.URL + separator + params.Encode()
+
+	resp, e := httpClient.Get(url)
+	if e != nil {
+		return TrackerResp{}, e
+	}
+	defer resp.Body.Close()
+	content, e := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if e != nil {
+		return TrackerResp{}, e
+	}
+
+	tracker, e := parseAnnounceResponse(content)
+	if e != nil {
+		// failure reasons can come with an error status, keep them
+		var failure *FailureError
+		if resp.StatusCode != http.StatusOK && !errors.As(e, &failure) {
+			return TrackerResp{}, fmt.Errorf("tracker answered %s", resp.Status)
+		}
+		return TrackerResp{}, e
+	}
+	if tracker.WarningMessage != "" {
+		log.Printf("Tracker %s: warning: %s\n", t.URL, tracker.WarningMessage)
+	}
+	if tracker.TrackerId != "" {
+		t.mu.Lock()
+		t.trackerId = tracker.TrackerId
+		t.mu.Unlock()
+	}
+	return tracker, nil
+}
+
+// httpAnnounceResp is the dictionary sent by HTTP trackers.
+type httpAnnounceResp struct {
+	Complete       int64              `bencode:"complete"`
+	Incomplete     int64              `bencode:"incomplete"`
+	Interval       int64              `bencode:"interval"`
+	MinInterval    int64              `bencode:"min interval"`
+	TrackerId      string             `bencode:"tracker id"`
+	FailureReason  *string            `bencode:"failure reason"`
+	RetryIn        decoder.RawMessage `bencode:"retry in"`
+	WarningMessage string             `bencode:"warning message"`
+	ExternalIP     []byte             `bencode:"external ip"`
+	Peers          decoder.RawMessage `bencode:"peers"`
+	Peers6         []byte             `bencode:"peers6"`
+}
+
+// dictPeer is a peer of the non compact peer list.
+type dictPeer struct {
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+	PeerId string `bencode:"peer id"`
+}
+
+/*
+parseAnnounceResponse parses the body of an announce. Missing counters are
+left at zero, peers can be a compact string or a list of dictionaries and
+IPv6 peers are added from peers6. A failure reason is returned as a
+*FailureError.
+*/
+func parseAnnounceResponse(content []byte) (TrackerResp, error) {
+	var raw httpAnnounceResp
+	if e := decoder.Unmarshal(content, &raw); e != nil {
+		return TrackerResp{}, fmt.Errorf("%w: %v", ErrInvalidResponse, e)
+	}
+	if raw.FailureReason != nil {
+		failure := &FailureError{Reason: *raw.FailureReason}
+		// retry in is minutes (BEP 31), or "never"
+		var minutes int64
+		if raw.RetryIn != nil && decoder.Unmarshal(raw.RetryIn, &minutes) == nil {
+			failure.RetryIn = minutes * 60
+		}
+		return TrackerResp{}, failure
+	}
+
+	tracker := TrackerResp{
+		Complete:       raw.Complete,
+		Incomplete:     raw.Incomplete,
+		Interval:       raw.Interval,
+		MinInterval:    raw.MinInterval,
+		TrackerId:      raw.TrackerId,
+		WarningMessage: raw.WarningMessage,
+	}
+	if len(raw.ExternalIP) == net.IPv4len || len(raw.ExternalIP) == net.IPv6len {
+		tracker.ExternalIP = net.IP(raw.ExternalIP)
+	}
+	peers, e := parsePeerList(raw.Peers)
+	if e != nil {
+		return TrackerResp{}, e
+	}
+	peers6, e := parsePeers6(raw.Peers6)
+	if e != nil {
+		return TrackerResp{}, e
+	}
+	tracker.Peers = append(peers, peers6...)
+	return tracker, nil
+}
+
+func parsePeerList(raw decoder.RawMessage) ([]IP, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] != 'l' {
+		var compact []byte
+		if e := decoder.Unmarshal(raw, &compact); e != nil {
+			return nil, fmt.Errorf("%w: peers: %v", ErrInvalidResponse, e)
+		}
+		return parsePeers(compact)
+	}
+
+	var list []dictPeer
+	if e := decoder.Unmarshal(raw, &list); e != nil {
+		return nil, fmt.Errorf("%w: peers: %v", ErrInvalidResponse, e)
+	}
+	ips := []IP{}
+	for _, peer := range list {
+		if peer.Port <= 0 || peer.Port > 65535 {
+			continue
+		}
+		// the ip can also be a dns name
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			addrs, e := net.LookupIP(peer.IP)
+			if e != nil || len(addrs) == 0 {
+				log.Printf("Skipping peer %s: %v\n", peer.IP, e)
+				continue
+			}
+			ip = addrs[0]
+		}
+		ips = append(ips, IP{IP: ip, Port: peer.Port, PeerId: peer.PeerId})
+	}
+	return ips, nil
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+Magnet holds the fields of a magnet URI. InfoHash is the 20 byte v1 hash
+from an urn:btih topic and InfoHashV2 the 32 byte SHA-256 from urn:btmh,
+at least one of them is set.
+*/
+type Magnet struct {
+	InfoHash   []byte
+	InfoHashV2 []byte
+	Name       string   // dn
+	Trackers   []string // tr
+	WebSeeds   []string // ws
+	Peers      []IP     // x.pe
+	SelectOnly []int    // so, file indexes
+}
+
+// ParseMagnet parses a magnet:?xt=urn:btih:... URI.
+func ParseMagnet(uri string) (Magnet, error) {
+	u, e := url.Parse(uri)
+	if e != nil {
+		return Magnet{}, e
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("not a magnet link: %q", uri)
+	}
+	query, e := url.ParseQuery(u.RawQuery)
+	if e != nil {
+		return Magnet{}, e
+	}
+
+	var m Magnet
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			m.InfoHash, e = parseBtih(strings.TrimPrefix(xt, "urn:btih:"))
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			m.InfoHashV2, e = parseBtmh(strings.TrimPrefix(xt, "urn:btmh:"))
+		}
+		if e != nil {
+			return Magnet{}, e
+		}
+	}
+	if m.InfoHash == nil && m.InfoHashV2 == nil {
+		return Magnet{}, errors.New("magnet link has no btih or btmh topic")
+	}
+
+	m.Name = query.Get("dn")
+	m.Trackers = query["tr"]
+	m.WebSeeds = query["ws"]
+	for _, pe := range query["x.pe"] {
+		ip, e := IPFromStr(pe)
+		if e != nil {
+			return Magnet{}, fmt.Errorf("x.pe %q: %w", pe, e)
+		}
+		m.Peers = append(m.Peers, ip)
+	}
+	for _, so := range query["so"] {
+		files, e := parseSelectOnly(so)
+		if e != nil {
+			return Magnet{}, e
+		}
+		m.SelectOnly = append(m.SelectOnly, files...)
+	}
+	return m, nil
+}
+
+// PeerInfoHash returns the 20 byte hash used with trackers and peers.
+func (m Magnet) PeerInfoHash() []byte {
+	if m.InfoHash != nil {
+		return m.InfoHash
+	}
+	return m.InfoHashV2[:20]
+}
+
+// parseBtih accepts the hex and the base32 forms of a v1 info hash.
+func parseBtih(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		return hex.DecodeString(s)
+	case 32:
+		return base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	}
+	return nil, fmt.Errorf("invalid btih %q", s)
+}
+
+// parseBtmh decodes a hex multihash, only SHA-256 (0x12, 32 bytes) is valid.
+func parseBtmh(s string) ([]byte, error) {
+	mh, e := hex.DecodeString(s)
+	if e != nil {
+		return nil, e
+	}
+	if len(mh) != 34 || mh[0] != 0x12 || mh[1] != 32 {
+		return nil, fmt.Errorf("invalid btmh %q", s)
+	}
+	return mh[2:], nil
+}
+
+// parseSelectOnly expands a list like "0,2,4-6" into file indexes.
+func parseSelectOnly(so string) ([]int, error) {
+	files := []int{}
+	for _, part := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, e := strconv.Atoi(first)
+		if e != nil || start < 0 {
+			return nil, fmt.Errorf("invalid so %q", so)
+		}
+		end := start
+		if isRange {
+			end, e = strconv.Atoi(last)
+			if e != nil || end < start || end-start > 1<<16 {
+				return nil, fmt.Errorf("invalid so %q", so)
+			}
+		}
+		for i := start; i <= end; i++ {
+			files = append(files, i)
+		}
+	}
+	return files, nil
+}
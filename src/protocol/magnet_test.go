@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	v1 := bytes.Repeat([]byte{0xab}, 20)
+	v2 := bytes.Repeat([]byte{0xcd}, 32)
+	btih := "urn:btih:" + hex.EncodeToString(v1)
+	btmh := "urn:btmh:1220" + hex.EncodeToString(v2)
+	cases := []struct {
+		uri  string
+		want Magnet
+	}{
+		{"magnet:?xt=" + btih, Magnet{InfoHash: v1}},
+		{"magnet:?xt=urn:btih:" + strings.ToUpper(hex.EncodeToString(v1)), Magnet{InfoHash: v1}},
+		{"magnet:?xt=urn:btih:" + strings.ToLower(base32.StdEncoding.EncodeToString(v1)), Magnet{InfoHash: v1}},
+		{"magnet:?xt=" + btmh, Magnet{InfoHashV2: v2}},
+		{"magnet:?xt=" + btih + "&xt=" + btmh, Magnet{InfoHash: v1, InfoHashV2: v2}},
+		{
+			"magnet:?xt=" + btih + "&dn=a+name&tr=http%3A%2F%2Ft1%2Fannounce&tr=udp%3A%2F%2Ft2%3A80&ws=http%3A%2F%2Fw",
+			Magnet{InfoHash: v1, Name: "a name", Trackers: []string{"http://t1/announce", "udp://t2:80"}, WebSeeds: []string{"http://w"}},
+		},
+		{
+			"magnet:?xt=" + btih + "&x.pe=10.0.0.1:6881&x.pe=[::1]:6882",
+			Magnet{InfoHash: v1, Peers: []IP{{IP: net.ParseIP("10.0.0.1"), Port: 6881}, {IP: net.ParseIP("::1"), Port: 6882}}},
+		},
+		{"magnet:?xt=" + btih + "&so=0,2,4-6&so=9", Magnet{InfoHash: v1, SelectOnly: []int{0, 2, 4, 5, 6, 9}}},
+		{"magnet:?xt=" + btih + "&so=3-3", Magnet{InfoHash: v1, SelectOnly: []int{3}}},
+	}
+	for _, c := range cases {
+		got, e := ParseMagnet(c.uri)
+		if e != nil {
+			t.Errorf("ParseMagnet(%q): %v", c.uri, e)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseMagnet(%q) = %+v, want %+v", c.uri, got, c.want)
+		}
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	btih := "xt=urn:btih:" + strings.Repeat("ab", 20)
+	cases := []string{
+		"http://host/?" + btih,
+		"magnet:?dn=name",
+		"magnet:?xt=urn:sha1:" + strings.Repeat("ab", 20),
+		"magnet:?xt=urn:btih:" + strings.Repeat("ab", 19),
+		"magnet:?xt=urn:btih:" + strings.Repeat("zz", 20),
+		"magnet:?xt=urn:btih:" + strings.Repeat("1", 32), // not base32
+		// sha1 multihash code, only sha2-256 is a v2 info hash
+		"magnet:?xt=urn:btmh:1114" + strings.Repeat("cd", 20),
+		"magnet:?xt=urn:btmh:1220" + strings.Repeat("cd", 31),
+		"magnet:?xt=urn:btmh:1221" + strings.Repeat("cd", 33),
+		"magnet:?" + btih + "&so=6-4",
+		"magnet:?" + btih + "&so=-1",
+		"magnet:?" + btih + "&so=1,,2",
+		"magnet:?" + btih + "&so=0-99999999",
+		"magnet:?" + btih + "&x.pe=10.0.0.1",
+		"magnet:?" + btih + "&x.pe=10.0.0.1:0",
+		"magnet:?" + btih + "&x.pe=10.0.0.1:http",
+	}
+	for _, uri := range cases {
+		if m, e := ParseMagnet(uri); e == nil {
+			t.Errorf("ParseMagnet(%q) = %+v, want an error", uri, m)
+		}
+	}
+}
+
+func TestMagnetPeerInfoHash(t *testing.T) {
+	v1 := bytes.Repeat([]byte{1}, 20)
+	v2 := append(bytes.Repeat([]byte{2}, 20), bytes.Repeat([]byte{3}, 12)...)
+	if got := (Magnet{InfoHash: v1, InfoHashV2: v2}).PeerInfoHash(); !bytes.Equal(got, v1) {
+		t.Errorf("hybrid PeerInfoHash = %x, want %x", got, v1)
+	}
+	// v2 only swarms use the truncated SHA-256
+	if got := (Magnet{InfoHashV2: v2}).PeerInfoHash(); !bytes.Equal(got, v2[:20]) {
+		t.Errorf("v2 PeerInfoHash = %x, want %x", got, v2[:20])
+	}
+}
@@ -2,160 +2,229 @@ package protocol
 
 import (
 	"bittorrent/src/decoder"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net"
+	"sync"
+	"time"
 )
 
-
-
 type Connection struct {
 	con net.Conn
+	// reserved bytes we and the peer sent in the handshake
+	localReserved  [8]byte
+	remoteReserved [8]byte
+	// pieces of the peer, once TrackPieces is called
+	pieces *peerPieces
+	state  *connState
+	// writeMu keeps messages written from several goroutines whole
+	writeMu sync.Mutex
 }
 
+// DialTimeout bounds how long CreateConnection waits for the peer to answer.
+var DialTimeout = 10 * time.Second
+
 /*Creates a TCP connection to the address and returns the Connection struct*/
-func CreateConnection(address string) (Connection, error) {
-	con, e := net.Dial("tcp", address)
+func CreateConnection(address string) (*Connection, error) {
+	con, e := net.DialTimeout("tcp", address, DialTimeout)
 	if e != nil {
-		return Connection{}, e
+		return nil, e
 	}
-	return Connection{
-		con: con,
-	}, nil
+	return NewConnection(con), nil
 }
-func (c *Connection) SendInterested() (int, error) {
-	content := []byte{}
-	content = append(content, []byte{0, 0, 0, 1}...)
-	content = append(content, byte(INTERESTED))
-	return c.con.Write(content)
+
+// NewConnection wraps an established connection, such as one we accepted.
+func NewConnection(con net.Conn) *Connection {
+	return &Connection{
+		con:   con,
+		state: newConnState(),
+	}
 }
 
-/* Sends a request message
-* @return number of bytes sent or error
- */
-func (c *Connection) SendRequest(payload PeerRequest) (int, error) {
-	msg := peerRequestToBytes(payload)
-	//log.Println("PROTOCOL: OUT-> Request")
+// WriteMessage sends a message to the peer.
+func (c *Connection) WriteMessage(m Message) error {
+	_, e := c.send(m)
+	return e
+}
+
+/*
+ReadMessage waits for the next message of the peer. With TrackPieces the
+pieces of the peer are updated from it, and an invalid bitfield is an error.
+*/
+func (c *Connection) ReadMessage() (Message, error) {
+	msg, e := ReadMessage(c.con)
+	if e != nil {
+		return nil, e
+	}
+	if c.pieces != nil {
+		if e := c.pieces.update(msg); e != nil {
+			return nil, e
+		}
+	}
+	return msg, nil
+}
+
+func (c *Connection) send(m Message) (int, error) {
+	msg, e := m.MarshalBinary()
+	if e != nil {
+		return 0, e
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	return c.con.Write(msg)
 }
 
-func (c *Connection) SendHave(index uint32) (int, error) {
-	haveMsg := HaveMessage{
-		LengthPrefix: 5,
-		MsgType:      HAVE,
-		Index:        index,
+/* Sends a request message, which peers drop while they choke us.
+* @return number of bytes sent or ErrChoked
+ */
+func (c *Connection) SendRequest(request Request) (int, error) {
+	c.state.mu.Lock()
+	if c.state.PeerChoking {
+		c.state.mu.Unlock()
+		return 0, ErrChoked
 	}
-	//log.Println("PROTOCOL: OUT-> HAVE")
-	return c.con.Write(haveMsg.toBytes())
+	c.state.outstanding[blockKey{request.Index, request.Begin}] = outstandingRequest{request, time.Now()}
+	c.state.mu.Unlock()
+	return c.send(request)
+}
 
+func (c *Connection) SendHave(index uint32) (int, error) {
+	return c.send(Have{Index: index})
 }
 
 /* Makes the handshake to the connection with the peer message.
 * @returns a tuple with the peer id or the error
  */
-func (c *Connection)Handshake(handshake PeerHandshake) (string, error) {
+func (c *Connection) Handshake(handshake PeerHandshake) (string, error) {
 	msg := peerHandshakeToBytes(handshake)
+	c.localReserved = handshake.Reserved
 	_, e := c.con.Write(msg)
 	//log.Println("PROTOCOL: OUT-> Handshake")
 	if e != nil {
 		return "", e
 	}
-	buffer := make([]byte, 68)
-	_, e = c.con.Read(buffer)
+	remote, e := c.readHandshake()
 	if e != nil {
 		return "", e
 	}
+	if remote.InfoHash != handshake.InfoHash {
+		return "", errors.New("peer answered with another info hash")
+	}
 
-	peerId := buffer[len(buffer)-20:]
-	hexadecimalPeerId := fmt.Sprintf("%x", peerId)
+	hexadecimalPeerId := fmt.Sprintf("%x", remote.PeerId)
 	//log.Println("PROTOCOL: IN-> Handshake")
 
 	return hexadecimalPeerId, nil
 }
 
-func (c *Connection)DownloadPiece(index int, info decoder.Info) ([]byte, int, error) {
-
-	pieceSize := info.PieceLength
-	numPieces := int(math.Ceil(float64(info.Length) / float64(pieceSize)))
-	if index == numPieces-1 {
-		pieceSize = info.Length - (numPieces-1)*pieceSize //if last piece size is remaining bytes
+/*
+AcceptHandshake handshakes with a peer that connected to us, which speaks
+first. answer returns our handshake for the info hash the peer asked for,
+or an error to refuse it. It returns the handshake of the peer.
+*/
+func (c *Connection) AcceptHandshake(answer func(infoHash []byte) (PeerHandshake, error)) (PeerHandshake, error) {
+	remote, e := c.readHandshake()
+	if e != nil {
+		return PeerHandshake{}, e
 	}
-
-	blockSize := 16 * 1024 //block size
-	numBlocks := int(math.Ceil(float64(pieceSize) / float64(blockSize)))
-	piece := NewPiece(uint32(index), uint32(pieceSize))
-	//log.Println("Downloading piece", index)
-    	for i := range numBlocks {
-        fmt.Print("+")
-
-		currentSize := blockSize
-		if i == numBlocks-1 { //if last block
-			currentSize = int(pieceSize - blockSize*i) // because of the offset for begin
-		}
-		//send request
-		requestMsg := CreatePeerRequest(uint32(index), uint32(i*blockSize), uint32(currentSize))
-		content := peerRequestToBytes(requestMsg)
-		c.con.Write(content)
-		//log.Printf("Request sent to peer: %+v\n", content)
-		msgType, response, e := c.WaitResponse()
-		if e != nil {
-			return []byte{}, 0, e
-		}
-		var pieceResponse PieceResponse
-		if msgType == PIECE {
-			pieceResponse = c.ManageResponse(msgType, response).(PieceResponse)
-		} else {
-			return []byte{}, 0, errors.New("Got another pacakge, not PIECE")
-		}
-		piece.AddBlock(pieceResponse.Block, i)
-		//log.Printf("Block %d downloaded.\n", i)
+	handshake, e := answer([]byte(remote.InfoHash))
+	if e != nil {
+		return PeerHandshake{}, e
 	}
-        fmt.Print("\r\033[K")
-    if !piece.IsComplete() {
-		return []byte{}, pieceSize, errors.New("The piece is not complete")
+	c.localReserved = handshake.Reserved
+	if _, e := c.con.Write(peerHandshakeToBytes(handshake)); e != nil {
+		return PeerHandshake{}, e
 	}
-	pieceData := piece.ConcatBlocks()
-	return pieceData, pieceSize, nil
-
+	return remote, nil
 }
-func (c *Connection) WaitResponse() (Type, []byte, error) {
-	//log.Println("Waiting for peer response")
-	prefixBuffer := make([]byte, 4)
-	_, e := c.con.Read(prefixBuffer)
-	if e != nil {
-		return 0, []byte{}, e
-	}
-	length := binary.BigEndian.Uint32(prefixBuffer)
 
-    if length == 0 {
-        return 9,nil,nil
-    }
-	buffer := make([]byte, length)
-	_, e = io.ReadFull(c.con, buffer)
-	if e != nil {
-		return 0, []byte{}, e
+// readHandshake reads the handshake of the peer and keeps its reserved bytes.
+func (c *Connection) readHandshake() (PeerHandshake, error) {
+	buffer := make([]byte, 68)
+	if _, e := io.ReadFull(c.con, buffer); e != nil {
+		return PeerHandshake{}, e
+	}
+	if buffer[0] != 19 || string(buffer[1:20]) != "BitTorrent protocol" {
+		return PeerHandshake{}, errors.New("peer did not send a BitTorrent handshake")
 	}
-	msgType := Type(buffer[0])
+	copy(c.remoteReserved[:], buffer[20:28])
+	return PeerHandshake{
+		Protocol: string(buffer[1:20]),
+		Reserved: c.remoteReserved,
+		InfoHash: string(buffer[28:48]),
+		PeerId:   string(buffer[48:68]),
+	}, nil
+}
+
+// SetDeadline bounds the reads and writes of the connection, as in net.Conn.
+func (c *Connection) SetDeadline(t time.Time) error {
+	return c.con.SetDeadline(t)
+}
 
-    //log.Printf("PROTOCOL: IN->%s\n", msgType.String())
+// RemoteAddr returns the address of the peer.
+func (c *Connection) RemoteAddr() string {
+	return c.con.RemoteAddr().String()
+}
 
-	return msgType, buffer[1:], nil
+// SupportsExtensions reports whether both handshakes advertised BEP 10.
+func (c *Connection) SupportsExtensions() bool {
+	return c.localReserved[5]&c.remoteReserved[5]&extensionBit != 0
+}
 
+// SupportsFast reports whether both handshakes advertised BEP 6, its messages may be sent only then.
+func (c *Connection) SupportsFast() bool {
+	return c.localReserved[7]&c.remoteReserved[7]&fastBit != 0
 }
 
-func (c *Connection) ManageResponse(msgType Type, buffer []byte) any {
-	switch msgType {
-	case HAVE:
-		index := binary.BigEndian.Uint32(buffer)
-		return index
-	case PIECE:
-		return BytesToPiece(buffer)
-	default: //if default return buffer as it is
-		return buffer
+// Close closes the connection and removes the pieces of the peer from the swarm.
+func (c *Connection) Close() error {
+	c.state.close.Do(func() { close(c.state.done) })
+	if c.pieces != nil {
+		c.pieces.mu.Lock()
+		c.pieces.replace(NewBitfield(c.pieces.numPieces))
+		c.pieces.mu.Unlock()
 	}
+	return c.con.Close()
 }
 
+/*
+DownloadPiece downloads a whole piece, starting the reader goroutine if
+needed. It tells the peer we are interested and waits for it to unchoke
+us, a choke in the middle only delays the blocks left.
+*/
+func (c *Connection) DownloadPiece(index int, info decoder.Info) ([]byte, int, error) {
+	events := c.Start()
+	if e := c.SetInterested(true); e != nil {
+		return nil, 0, e
+	}
+	pieceSize := info.PieceSize(index) //if last piece size is remaining bytes
+	piece := make([]byte, pieceSize)
+	requests := BlockRequests(index, pieceSize)
+	if e := c.QueueRequests(requests...); e != nil {
+		return nil, 0, e
+	}
 
+	for received := 0; received < len(requests); {
+		event, ok := <-events
+		if !ok {
+			return nil, 0, errors.New("connection closed")
+		}
+		switch event.Type {
+		case PeerClosed:
+			return nil, 0, event.Err
+		case RequestRejected:
+			return nil, 0, errors.New("peer rejected a block of the piece")
+		case BlockReceived:
+			block := event.Message.(Piece)
+			if int(block.Index) != index {
+				continue
+			}
+			fmt.Print("+")
+			copy(piece[block.Begin:], block.Block)
+			received++
+		}
+	}
+	fmt.Print("\r\033[K")
+	return piece, pieceSize, nil
+}
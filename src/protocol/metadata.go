@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"bittorrent/src/decoder"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// extended message id of the extension handshake
+	extHandshakeId = 0
+	// id we ask peers to use when they send us ut_metadata messages
+	localMetadataId = 1
+
+	metadataPieceSize = 16 * 1024
+	maxMetadataSize   = 16 << 20
+)
+
+// ut_metadata message types (BEP 9)
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// MetadataTimeout bounds a whole metadata exchange with a single peer.
+var MetadataTimeout = 30 * time.Second
+
+// ExtensionHandshake is the payload of the BEP 10 extension handshake.
+type ExtensionHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+}
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+/* Sends an extended message (BEP 10) with the given extension id.
+* @return number of bytes sent or error
+ */
+func (c *Connection) SendExtended(id uint8, payload []byte) (int, error) {
+	return c.send(Extended{ID: id, Payload: payload})
+}
+
+/* Waits for the next extended message, dropping any other message.
+* @return the extension id and the payload after it
+ */
+func (c *Connection) WaitExtended() (uint8, []byte, error) {
+	for {
+		msg, e := c.ReadMessage()
+		if e != nil {
+			return 0, nil, e
+		}
+		if extended, ok := msg.(Extended); ok {
+			return extended.ID, extended.Payload, nil
+		}
+	}
+}
+
+/*
+FetchMetadata downloads the info dictionary from a peer with the ut_metadata
+extension (BEP 9). The handshake must have been made with extensions
+enabled. infoHash is a 20 byte SHA-1 or a 32 byte SHA-256 and the metadata
+is only returned if it matches.
+*/
+func (c *Connection) FetchMetadata(infoHash []byte) ([]byte, error) {
+	if !c.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+	c.con.SetDeadline(time.Now().Add(MetadataTimeout))
+	defer c.con.SetDeadline(time.Time{})
+
+	handshake, _ := decoder.Marshal(ExtensionHandshake{
+		M: map[string]int{"ut_metadata": localMetadataId},
+	})
+	if _, e := c.SendExtended(extHandshakeId, handshake); e != nil {
+		return nil, e
+	}
+
+	var remote ExtensionHandshake
+	for {
+		id, payload, e := c.WaitExtended()
+		if e != nil {
+			return nil, e
+		}
+		if id != extHandshakeId {
+			continue
+		}
+		if e := decoder.Unmarshal(payload, &remote); e != nil {
+			return nil, fmt.Errorf("extension handshake: %w", e)
+		}
+		break
+	}
+	remoteId := remote.M["ut_metadata"]
+	if remoteId <= 0 || remoteId > 255 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+	size := remote.MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	metadata := make([]byte, size)
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	for i := range numPieces {
+		request, _ := decoder.Marshal(metadataMessage{MsgType: metadataRequest, Piece: i})
+		if _, e := c.SendExtended(uint8(remoteId), request); e != nil {
+			return nil, e
+		}
+		data, e := c.waitMetadataPiece(i)
+		if e != nil {
+			return nil, e
+		}
+		expected := min(metadataPieceSize, size-i*metadataPieceSize)
+		if len(data) != expected {
+			return nil, fmt.Errorf("metadata piece %d has %d bytes, expected %d", i, len(data), expected)
+		}
+		copy(metadata[i*metadataPieceSize:], data)
+	}
+
+	if !verifyInfoHash(metadata, infoHash) {
+		return nil, errors.New("metadata does not match the info hash")
+	}
+	return metadata, nil
+}
+
+// waitMetadataPiece waits for the ut_metadata data message of piece index.
+func (c *Connection) waitMetadataPiece(index int) ([]byte, error) {
+	for {
+		id, payload, e := c.WaitExtended()
+		if e != nil {
+			return nil, e
+		}
+		if id != localMetadataId {
+			continue
+		}
+		// the dictionary is followed by the piece data
+		d := decoder.NewDecoder(bytes.NewReader(payload))
+		var msg metadataMessage
+		if e := d.DecodeInto(&msg); e != nil {
+			return nil, fmt.Errorf("ut_metadata message: %w", e)
+		}
+		switch msg.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+		case metadataData:
+			if msg.Piece != index {
+				continue
+			}
+			return payload[d.Offset():], nil
+		}
+	}
+}
+
+func verifyInfoHash(metadata []byte, infoHash []byte) bool {
+	switch len(infoHash) {
+	case sha1.Size:
+		hash := sha1.Sum(metadata)
+		return bytes.Equal(hash[:], infoHash)
+	case sha256.Size:
+		hash := sha256.Sum256(metadata)
+		return bytes.Equal(hash[:], infoHash)
+	}
+	return false
+}
+
+/*
+ResolveMagnet finds peers through the trackers and x.pe peers of the magnet
+link and downloads the info dictionary from the first one that has it. The
+trackers and web seeds of the magnet link are kept in the MetaInfo.
+*/
+func ResolveMagnet(m Magnet) (decoder.MetaInfo, error) {
+	peers := append([]IP{}, m.Peers...)
+	if len(m.Trackers) > 0 {
+		// every tr is a tier of its own, left is unknown until the metadata arrives
+		tiers := [][]string{}
+		for _, tracker := range m.Trackers {
+			tiers = append(tiers, []string{tracker})
+		}
+		found, e := Announce(NewTrackerTiers(tiers), m.PeerInfoHash(), 1)
+		if e != nil {
+			log.Println(e)
+		}
+		peers = append(peers, found...)
+	}
+	if len(peers) == 0 {
+		return decoder.MetaInfo{}, errors.New("no peers found for magnet link")
+	}
+
+	expected := m.InfoHash
+	if expected == nil {
+		expected = m.InfoHashV2
+	}
+	for _, peer := range peers {
+		metadata, e := fetchMetadataFrom(peer, m.PeerInfoHash(), expected)
+		if e != nil {
+			log.Printf("Metadata from %s: %v\n", peer.String(), e)
+			continue
+		}
+		metaInfo, e := decoder.MetaInfoFromInfoBytes(metadata, "")
+		if e != nil {
+			return decoder.MetaInfo{}, e
+		}
+		if len(m.Trackers) > 0 {
+			metaInfo.Announce = m.Trackers[0]
+		}
+		if len(m.Trackers) > 1 {
+			for _, tracker := range m.Trackers {
+				metaInfo.AnnounceList = append(metaInfo.AnnounceList, []string{tracker})
+			}
+		}
+		metaInfo.UrlList = m.WebSeeds
+		return metaInfo, nil
+	}
+	return decoder.MetaInfo{}, errors.New("no peer sent the metadata")
+}
+
+func fetchMetadataFrom(peer IP, peerInfoHash []byte, expected []byte) ([]byte, error) {
+	con, e := CreateConnection(peer.String())
+	if e != nil {
+		return nil, e
+	}
+	defer con.Close()
+	con.con.SetDeadline(time.Now().Add(MetadataTimeout))
+
+	handshake := NewHandshake(peerInfoHash)
+	handshake.EnableExtensions()
+	if _, e := con.Handshake(handshake); e != nil {
+		return nil, e
+	}
+	return con.FetchMetadata(expected)
+}
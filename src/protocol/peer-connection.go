@@ -0,0 +1,440 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BlockSize is the size of the requests we send, the last block of a piece may be shorter.
+const BlockSize = 16 * 1024
+
+/*
+Bounds of the request window, the number of requests sent and not answered
+yet. The window is sized to keep requestQueueTime of data in flight on top
+of the round trip, from the measured rate and latency of the peer.
+*/
+const (
+	MinRequestWindow     = 2
+	MaxRequestWindow     = 256
+	initialRequestWindow = 8
+	requestQueueTime     = time.Second
+)
+
+var ErrChoked = errors.New("peer is choking us")
+
+type PeerEventType int
+
+const (
+	// PeerChoked carries in Requests the requests that were re-queued
+	PeerChoked PeerEventType = iota
+	PeerUnchoked
+	PeerInterested
+	PeerNotInterested
+	// PeerHasPieces is a BITFIELD, HAVE, HAVE_ALL or HAVE_NONE, already applied
+	PeerHasPieces
+	// BlockReceived carries the Piece of one of our requests
+	BlockReceived
+	// BlockRequested carries a Request of the peer, only sent while we unchoke it
+	BlockRequested
+	RequestCancelled
+	// RequestRejected carries in Requests our request the peer will not answer (BEP 6)
+	RequestRejected
+	// MessageReceived is any other message, such as extended messages
+	MessageReceived
+	// PeerClosed is the last event, Err tells why the connection ended
+	PeerClosed
+)
+
+// PeerEvent is sent by the reader goroutine for each message that matters.
+type PeerEvent struct {
+	Type     PeerEventType
+	Message  Message
+	Requests []Request
+	Err      error
+}
+
+// PeerState holds the four choke and interest flags of a connection.
+type PeerState struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+// blockKey identifies a block, PIECE messages may come in any order.
+type blockKey struct {
+	index uint32
+	begin uint32
+}
+
+type outstandingRequest struct {
+	Request
+	sentAt time.Time
+}
+
+type connState struct {
+	mu sync.Mutex
+	PeerState
+	// queue holds requests waiting for the peer to unchoke us or for room in the window
+	queue       []Request
+	outstanding map[blockKey]outstandingRequest
+	window      int
+
+	latency   time.Duration // moving average of the request round trip
+	rate      float64       // moving average of bytes per second received
+	rateBytes int64
+	rateStart time.Time
+	lastBlock time.Time
+	// wasted counts bytes of blocks we did not ask for, or got twice
+	wasted int64
+
+	started bool
+	events  chan PeerEvent
+	done    chan struct{}
+	close   sync.Once
+}
+
+func newConnState() *connState {
+	return &connState{
+		PeerState:   PeerState{AmChoking: true, PeerChoking: true},
+		outstanding: make(map[blockKey]outstandingRequest),
+		window:      initialRequestWindow,
+		rateStart:   time.Now(),
+		events:      make(chan PeerEvent, 64),
+		done:        make(chan struct{}),
+	}
+}
+
+/*
+Start runs the reader goroutine and returns its events. Once started the
+messages must not be read with ReadMessage or WaitExtended, the channel is
+closed after the PeerClosed event. Calling it again returns the same channel.
+*/
+func (c *Connection) Start() <-chan PeerEvent {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	if !c.state.started {
+		c.state.started = true
+		go c.readLoop()
+	}
+	return c.state.events
+}
+
+// State returns the choke and interest flags.
+func (c *Connection) State() PeerState {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return c.state.PeerState
+}
+
+// SetInterested tells the peer whether we want its pieces, if it changed.
+func (c *Connection) SetInterested(interested bool) error {
+	c.state.mu.Lock()
+	changed := c.state.AmInterested != interested
+	c.state.AmInterested = interested
+	c.state.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if interested {
+		return c.WriteMessage(Interested{})
+	}
+	return c.WriteMessage(NotInterested{})
+}
+
+// SetChoking chokes or unchokes the peer, if it changed.
+func (c *Connection) SetChoking(choking bool) error {
+	c.state.mu.Lock()
+	changed := c.state.AmChoking != choking
+	c.state.AmChoking = choking
+	c.state.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if choking {
+		return c.WriteMessage(Choke{})
+	}
+	return c.WriteMessage(Unchoke{})
+}
+
+/*
+Reject tells the peer a request will not be answered, with REJECT_REQUEST
+when both sides use the fast extension. Otherwise the peer learns it from
+the choke and nothing is sent.
+*/
+func (c *Connection) Reject(request Request) error {
+	if !c.SupportsFast() {
+		return nil
+	}
+	return c.WriteMessage(RejectRequest(request))
+}
+
+/*
+QueueRequests adds requests to send as soon as the peer unchokes us. If it
+chokes us while they are outstanding they go back to the queue.
+*/
+func (c *Connection) QueueRequests(requests ...Request) error {
+	c.state.mu.Lock()
+	c.state.queue = append(c.state.queue, requests...)
+	c.state.mu.Unlock()
+	return c.flush()
+}
+
+/*
+CancelRequest drops a request. It is removed from the queue, or a CANCEL
+is sent if it was already sent. It returns whether it was found.
+*/
+func (c *Connection) CancelRequest(request Request) (bool, error) {
+	c.state.mu.Lock()
+	if i := indexOfRequest(c.state.queue, request); i >= 0 {
+		c.state.queue = append(c.state.queue[:i], c.state.queue[i+1:]...)
+		c.state.mu.Unlock()
+		return true, nil
+	}
+	key := blockKey{request.Index, request.Begin}
+	_, found := c.state.outstanding[key]
+	delete(c.state.outstanding, key)
+	c.state.mu.Unlock()
+	if !found {
+		return false, nil
+	}
+	return true, c.WriteMessage(Cancel(request))
+}
+
+// Pending returns the requests queued or sent and not answered yet.
+func (c *Connection) Pending() []Request {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return append(c.state.sentRequests(), c.state.queue...)
+}
+
+// RequestWindow returns how many requests may be outstanding at once.
+func (c *Connection) RequestWindow() int {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return c.state.window
+}
+
+// DownloadRate returns the bytes per second received from the peer lately.
+func (c *Connection) DownloadRate() float64 {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.updateRate(time.Now())
+	return c.state.rate
+}
+
+// LastBlock returns when the last requested block arrived, zero if none did.
+func (c *Connection) LastBlock() time.Time {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return c.state.lastBlock
+}
+
+// Wasted returns the bytes of blocks that were dropped as unrequested or duplicate.
+func (c *Connection) Wasted() int64 {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return c.state.wasted
+}
+
+// flush sends queued requests while the peer unchokes us and the window has room.
+func (c *Connection) flush() error {
+	c.state.mu.Lock()
+	room := c.state.window - len(c.state.outstanding)
+	if c.state.PeerChoking || room <= 0 || len(c.state.queue) == 0 {
+		c.state.mu.Unlock()
+		return nil
+	}
+	batch := c.state.queue[:min(room, len(c.state.queue))]
+	c.state.queue = c.state.queue[len(batch):]
+	now := time.Now()
+	for _, request := range batch {
+		c.state.outstanding[blockKey{request.Index, request.Begin}] = outstandingRequest{request, now}
+	}
+	c.state.mu.Unlock()
+
+	for _, request := range batch {
+		if e := c.WriteMessage(request); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Connection) readLoop() {
+	defer close(c.state.events)
+	for {
+		msg, e := c.ReadMessage()
+		if e != nil {
+			c.emit(PeerEvent{Type: PeerClosed, Err: e})
+			return
+		}
+		if e := c.handle(msg); e != nil {
+			c.con.Close()
+			c.emit(PeerEvent{Type: PeerClosed, Err: e})
+			return
+		}
+	}
+}
+
+// handle updates the state from a message and sends its event.
+func (c *Connection) handle(msg Message) error {
+	s := c.state
+	switch msg := msg.(type) {
+	case KeepAlive:
+	case Choke:
+		s.mu.Lock()
+		s.PeerChoking = true
+		requeued := s.sentRequests()
+		s.queue = append(append([]Request{}, requeued...), s.queue...)
+		clear(s.outstanding)
+		s.mu.Unlock()
+		c.emit(PeerEvent{Type: PeerChoked, Message: msg, Requests: requeued})
+	case Unchoke:
+		s.mu.Lock()
+		s.PeerChoking = false
+		s.mu.Unlock()
+		c.emit(PeerEvent{Type: PeerUnchoked, Message: msg})
+		return c.flush()
+	case Interested:
+		s.mu.Lock()
+		s.PeerInterested = true
+		s.mu.Unlock()
+		c.emit(PeerEvent{Type: PeerInterested, Message: msg})
+	case NotInterested:
+		s.mu.Lock()
+		s.PeerInterested = false
+		s.mu.Unlock()
+		c.emit(PeerEvent{Type: PeerNotInterested, Message: msg})
+	case Bitfield, Have, HaveAll, HaveNone:
+		c.emit(PeerEvent{Type: PeerHasPieces, Message: msg})
+	case Piece:
+		key := blockKey{msg.Index, msg.Begin}
+		s.mu.Lock()
+		sent, ok := s.outstanding[key]
+		if ok && int(sent.Length) != len(msg.Block) {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: block of %d bytes, requested %d", ErrInvalidMessage, len(msg.Block), sent.Length)
+		}
+		if !ok {
+			// blocks we did not ask for, cancelled or already received are dropped
+			s.wasted += int64(len(msg.Block))
+			s.mu.Unlock()
+			return nil
+		}
+		delete(s.outstanding, key)
+		s.received(len(msg.Block), time.Since(sent.sentAt))
+		s.mu.Unlock()
+		c.emit(PeerEvent{Type: BlockReceived, Message: msg})
+		return c.flush()
+	case Request:
+		if c.State().AmChoking {
+			return c.Reject(msg)
+		}
+		c.emit(PeerEvent{Type: BlockRequested, Message: msg})
+	case Cancel:
+		c.emit(PeerEvent{Type: RequestCancelled, Message: msg})
+	case RejectRequest:
+		key := blockKey{msg.Index, msg.Begin}
+		s.mu.Lock()
+		_, ok := s.outstanding[key]
+		delete(s.outstanding, key)
+		s.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		c.emit(PeerEvent{Type: RequestRejected, Message: msg, Requests: []Request{Request(msg)}})
+		return c.flush()
+	default:
+		c.emit(PeerEvent{Type: MessageReceived, Message: msg})
+	}
+	return nil
+}
+
+// emit sends an event unless the connection was closed.
+func (c *Connection) emit(event PeerEvent) {
+	select {
+	case c.state.events <- event:
+	case <-c.state.done:
+	}
+}
+
+// sentRequests returns the outstanding requests in piece order.
+func (s *connState) sentRequests() []Request {
+	requests := []Request{}
+	for _, sent := range s.outstanding {
+		requests = append(requests, sent.Request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].Index != requests[j].Index {
+			return requests[i].Index < requests[j].Index
+		}
+		return requests[i].Begin < requests[j].Begin
+	})
+	return requests
+}
+
+// received updates the latency, rate and window with a block that arrived after rtt.
+func (s *connState) received(size int, rtt time.Duration) {
+	if s.latency == 0 {
+		s.latency = rtt
+	} else {
+		s.latency = (4*s.latency + rtt) / 5
+	}
+	s.rateBytes += int64(size)
+	s.lastBlock = time.Now()
+	s.updateRate(s.lastBlock)
+	if s.rate == 0 {
+		// no rate yet, grow like a slow start
+		s.window = min(MaxRequestWindow, s.window+1)
+		return
+	}
+
+	// with rate measured against the current window, the queue time on top
+	// of the round trip lets the window grow until the peer is saturated
+	inFlight := s.rate * (s.latency + requestQueueTime).Seconds()
+	window := int(math.Ceil(inFlight / BlockSize))
+	s.window = max(MinRequestWindow, min(MaxRequestWindow, window, 2*s.window))
+}
+
+// updateRate folds the bytes of each full second into the moving average.
+func (s *connState) updateRate(now time.Time) {
+	elapsed := now.Sub(s.rateStart)
+	if elapsed < time.Second {
+		return
+	}
+	sample := float64(s.rateBytes) / elapsed.Seconds()
+	if s.rate == 0 {
+		s.rate = sample
+	} else {
+		s.rate = 0.7*s.rate + 0.3*sample
+	}
+	s.rateBytes = 0
+	s.rateStart = now
+}
+
+func indexOfRequest(requests []Request, request Request) int {
+	for i, r := range requests {
+		if r == request {
+			return i
+		}
+	}
+	return -1
+}
+
+// BlockRequests returns the requests for all the blocks of a piece.
+func BlockRequests(index int, pieceSize int) []Request {
+	requests := []Request{}
+	for begin := 0; begin < pieceSize; begin += BlockSize {
+		requests = append(requests, Request{
+			Index:  uint32(index),
+			Begin:  uint32(begin),
+			Length: uint32(min(BlockSize, pieceSize-begin)),
+		})
+	}
+	return requests
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of the type, failing after a second.
+func nextEvent(t *testing.T, events <-chan PeerEvent, eventType PeerEventType) PeerEvent {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == eventType {
+				return event
+			}
+			if event.Type == PeerClosed {
+				t.Fatalf("connection closed waiting for event %d: %v", eventType, event.Err)
+			}
+		case <-timeout:
+			t.Fatalf("no event %d", eventType)
+		}
+	}
+}
+
+func TestRejectedRequestLeavesWindow(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := NewConnection(local)
+	defer conn.Close()
+	events := conn.Start()
+
+	go func() {
+		remote.Write(mustMarshal(Unchoke{}))
+		for {
+			msg, e := ReadMessage(remote)
+			if e != nil {
+				return
+			}
+			if r, ok := msg.(Request); ok && r.Begin == 0 {
+				remote.Write(mustMarshal(RejectRequest(r)))
+			}
+		}
+	}()
+	nextEvent(t, events, PeerUnchoked)
+	requests := []Request{{Index: 1, Begin: 0, Length: BlockSize}, {Index: 1, Begin: BlockSize, Length: BlockSize}}
+	if e := conn.QueueRequests(requests...); e != nil {
+		t.Fatal(e)
+	}
+	event := nextEvent(t, events, RequestRejected)
+	if len(event.Requests) != 1 || event.Requests[0] != requests[0] {
+		t.Errorf("rejected %v, want %v", event.Requests, requests[0])
+	}
+	if pending := conn.Pending(); len(pending) != 1 || pending[0] != requests[1] {
+		t.Errorf("pending %v, want only %v", pending, requests[1])
+	}
+}
+
+func mustMarshal(m Message) []byte {
+	msg, e := m.MarshalBinary()
+	if e != nil {
+		panic(e)
+	}
+	return msg
+}
@@ -0,0 +1,244 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+MaxMessageLength is the largest frame ReadMessage accepts, length prefix
+excluded. 1 MiB fits the bitfield of 8 million pieces and 128 KiB blocks.
+*/
+var MaxMessageLength uint32 = 1 << 20
+
+var (
+	ErrMessageTooLong = errors.New("peer message too long")
+	ErrInvalidMessage = errors.New("invalid peer message")
+)
+
+/*
+Message is a message of the peer wire protocol. MarshalBinary returns the
+whole frame, length prefix included.
+*/
+type Message interface {
+	MarshalBinary() ([]byte, error)
+}
+
+type KeepAlive struct{}
+type Choke struct{}
+type Unchoke struct{}
+type Interested struct{}
+type NotInterested struct{}
+
+// HaveAll and HaveNone replace the bitfield when both peers use the fast extension.
+type HaveAll struct{}
+type HaveNone struct{}
+
+type Have struct {
+	Index uint32
+}
+
+// Bitfield has one bit per piece, the high bit of the first byte is piece 0.
+type Bitfield []byte
+
+type Request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+type Cancel struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// RejectRequest tells a peer using the fast extension that a request will not be answered.
+type RejectRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// Port is the DHT port of the peer (BEP 5).
+type Port struct {
+	Port uint16
+}
+
+// Extended is a BEP 10 message, ID 0 being the extension handshake.
+type Extended struct {
+	ID      uint8
+	Payload []byte
+}
+
+// UnknownMessage is a message with an id we do not implement, kept as read.
+type UnknownMessage struct {
+	ID      Type
+	Payload []byte
+}
+
+// frame returns a message with the length prefix and id set and room for payloadLength bytes.
+func frame(id Type, payloadLength int) []byte {
+	msg := make([]byte, 5, 5+payloadLength)
+	binary.BigEndian.PutUint32(msg, uint32(1+payloadLength))
+	msg[4] = byte(id)
+	return msg
+}
+
+// blockFrame is the frame of REQUEST, CANCEL and REJECT_REQUEST.
+func blockFrame(id Type, index, begin, length uint32) []byte {
+	msg := frame(id, 12)
+	msg = binary.BigEndian.AppendUint32(msg, index)
+	msg = binary.BigEndian.AppendUint32(msg, begin)
+	return binary.BigEndian.AppendUint32(msg, length)
+}
+
+func (KeepAlive) MarshalBinary() ([]byte, error)     { return make([]byte, 4), nil }
+func (Choke) MarshalBinary() ([]byte, error)         { return frame(CHOKE, 0), nil }
+func (Unchoke) MarshalBinary() ([]byte, error)       { return frame(UNCHOKE, 0), nil }
+func (Interested) MarshalBinary() ([]byte, error)    { return frame(INTERESTED, 0), nil }
+func (NotInterested) MarshalBinary() ([]byte, error) { return frame(NOT_INTEREST, 0), nil }
+func (HaveAll) MarshalBinary() ([]byte, error)       { return frame(HAVE_ALL, 0), nil }
+func (HaveNone) MarshalBinary() ([]byte, error)      { return frame(HAVE_NONE, 0), nil }
+
+func (m Have) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(frame(HAVE, 4), m.Index), nil
+}
+
+func (m Bitfield) MarshalBinary() ([]byte, error) {
+	return append(frame(BITFIELD, len(m)), m...), nil
+}
+
+func (m Request) MarshalBinary() ([]byte, error) {
+	return blockFrame(REQUEST, m.Index, m.Begin, m.Length), nil
+}
+
+func (m Cancel) MarshalBinary() ([]byte, error) {
+	return blockFrame(CANCEL, m.Index, m.Begin, m.Length), nil
+}
+
+func (m RejectRequest) MarshalBinary() ([]byte, error) {
+	return blockFrame(REJECT, m.Index, m.Begin, m.Length), nil
+}
+
+func (m Piece) MarshalBinary() ([]byte, error) {
+	msg := frame(PIECE, 8+len(m.Block))
+	msg = binary.BigEndian.AppendUint32(msg, m.Index)
+	msg = binary.BigEndian.AppendUint32(msg, m.Begin)
+	return append(msg, m.Block...), nil
+}
+
+func (m Port) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint16(frame(PORT, 2), m.Port), nil
+}
+
+func (m Extended) MarshalBinary() ([]byte, error) {
+	msg := append(frame(EXTENDED, 1+len(m.Payload)), m.ID)
+	return append(msg, m.Payload...), nil
+}
+
+func (m UnknownMessage) MarshalBinary() ([]byte, error) {
+	return append(frame(m.ID, len(m.Payload)), m.Payload...), nil
+}
+
+/*
+ReadMessage reads one frame. Frames longer than MaxMessageLength are
+rejected before reading them, a frame cut short returns
+io.ErrUnexpectedEOF and io.EOF is only returned between frames.
+*/
+func ReadMessage(r io.Reader) (Message, error) {
+	var prefix [4]byte
+	if _, e := io.ReadFull(r, prefix[:]); e != nil {
+		return nil, e
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return KeepAlive{}, nil
+	}
+	if length > MaxMessageLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLong, length)
+	}
+	buffer := make([]byte, length)
+	if _, e := io.ReadFull(r, buffer); e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return nil, e
+	}
+	return ParseMessage(Type(buffer[0]), buffer[1:])
+}
+
+// payloadSizes holds the payload size of the messages that have a fixed one.
+var payloadSizes = map[Type]int{
+	CHOKE: 0, UNCHOKE: 0, INTERESTED: 0, NOT_INTEREST: 0, HAVE_ALL: 0, HAVE_NONE: 0,
+	HAVE: 4, REQUEST: 12, CANCEL: 12, REJECT: 12, PORT: 2,
+}
+
+// ParseMessage builds the message of type id from its payload.
+func ParseMessage(id Type, payload []byte) (Message, error) {
+	if size, ok := payloadSizes[id]; ok && len(payload) != size {
+		return nil, fmt.Errorf("%w: %s with %d bytes of payload", ErrInvalidMessage, id, len(payload))
+	}
+
+	switch id {
+	case CHOKE:
+		return Choke{}, nil
+	case UNCHOKE:
+		return Unchoke{}, nil
+	case INTERESTED:
+		return Interested{}, nil
+	case NOT_INTEREST:
+		return NotInterested{}, nil
+	case HAVE_ALL:
+		return HaveAll{}, nil
+	case HAVE_NONE:
+		return HaveNone{}, nil
+	case HAVE:
+		return Have{Index: binary.BigEndian.Uint32(payload)}, nil
+	case BITFIELD:
+		return Bitfield(payload), nil
+	case REQUEST:
+		return Request{
+			Index:  binary.BigEndian.Uint32(payload[0:4]),
+			Begin:  binary.BigEndian.Uint32(payload[4:8]),
+			Length: binary.BigEndian.Uint32(payload[8:12]),
+		}, nil
+	case CANCEL:
+		return Cancel{
+			Index:  binary.BigEndian.Uint32(payload[0:4]),
+			Begin:  binary.BigEndian.Uint32(payload[4:8]),
+			Length: binary.BigEndian.Uint32(payload[8:12]),
+		}, nil
+	case REJECT:
+		return RejectRequest{
+			Index:  binary.BigEndian.Uint32(payload[0:4]),
+			Begin:  binary.BigEndian.Uint32(payload[4:8]),
+			Length: binary.BigEndian.Uint32(payload[8:12]),
+		}, nil
+	case PIECE:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("%w: PIECE with %d bytes of payload", ErrInvalidMessage, len(payload))
+		}
+		return Piece{
+			Index: binary.BigEndian.Uint32(payload[0:4]),
+			Begin: binary.BigEndian.Uint32(payload[4:8]),
+			Block: payload[8:],
+		}, nil
+	case PORT:
+		return Port{Port: binary.BigEndian.Uint16(payload)}, nil
+	case EXTENDED:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("%w: empty EXTENDED", ErrInvalidMessage)
+		}
+		return Extended{ID: payload[0], Payload: payload[1:]}, nil
+	}
+	return UnknownMessage{ID: id, Payload: payload}, nil
+}
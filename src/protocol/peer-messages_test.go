@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	cases := []Message{
+		KeepAlive{},
+		Choke{},
+		Unchoke{},
+		Interested{},
+		NotInterested{},
+		HaveAll{},
+		HaveNone{},
+		Have{Index: 7},
+		Bitfield{0xff, 0x80},
+		Request{Index: 1, Begin: BlockSize, Length: BlockSize},
+		Cancel{Index: 2, Begin: 0, Length: 100},
+		RejectRequest{Index: 3, Begin: BlockSize, Length: 5},
+		Piece{Index: 4, Begin: 8, Block: []byte("block")},
+		Port{Port: 6881},
+		Extended{ID: 2, Payload: []byte("d1:ai1ee")},
+		UnknownMessage{ID: 99, Payload: []byte{1, 2}},
+	}
+	for _, m := range cases {
+		frame, e := m.MarshalBinary()
+		if e != nil {
+			t.Errorf("%T.MarshalBinary: %v", m, e)
+			continue
+		}
+		if length := binary.BigEndian.Uint32(frame); int(length) != len(frame)-4 {
+			t.Errorf("%T: length prefix %d for %d bytes", m, length, len(frame)-4)
+		}
+		r := bytes.NewReader(frame)
+		got, e := ReadMessage(r)
+		if e != nil {
+			t.Errorf("ReadMessage(%T): %v", m, e)
+			continue
+		}
+		if !reflect.DeepEqual(got, m) || r.Len() != 0 {
+			t.Errorf("ReadMessage = %#v with %d bytes left, want %#v", got, r.Len(), m)
+		}
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	prefix := binary.BigEndian.AppendUint32(nil, MaxMessageLength+1)
+	// only the prefix is sent, the frame must be refused before reading its body
+	if _, e := ReadMessage(bytes.NewReader(prefix)); !errors.Is(e, ErrMessageTooLong) {
+		t.Errorf("ReadMessage of %d bytes = %v, want %v", MaxMessageLength+1, e, ErrMessageTooLong)
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	frame := mustMarshal(Piece{Index: 1, Block: []byte("block")})
+	cases := []struct {
+		input []byte
+		err   error
+	}{
+		{nil, io.EOF},
+		{frame[:2], io.ErrUnexpectedEOF},
+		{frame[:4], io.ErrUnexpectedEOF},
+		{frame[:len(frame)-1], io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		if _, e := ReadMessage(bytes.NewReader(c.input)); e != c.err {
+			t.Errorf("ReadMessage of %d bytes = %v, want %v", len(c.input), e, c.err)
+		}
+	}
+}
+
+func TestParseMessageWrongSize(t *testing.T) {
+	cases := []struct {
+		id      Type
+		payload int
+	}{
+		{CHOKE, 1},
+		{HAVE_ALL, 4},
+		{HAVE, 3},
+		{HAVE, 5},
+		{REQUEST, 11},
+		{CANCEL, 13},
+		{REJECT, 0},
+		{PORT, 4},
+		{PIECE, 7},
+		{EXTENDED, 0},
+	}
+	for _, c := range cases {
+		if _, e := ParseMessage(c.id, make([]byte, c.payload)); !errors.Is(e, ErrInvalidMessage) {
+			t.Errorf("ParseMessage(%s, %d bytes) = %v, want %v", c.id, c.payload, e, ErrInvalidMessage)
+		}
+	}
+}
@@ -1,10 +1,5 @@
 package protocol
 
-import (
-	"bytes"
-	"encoding/binary"
-)
-
 type Type uint8
 
 const (
@@ -17,14 +12,13 @@ const (
 	REQUEST      Type = 6
 	PIECE        Type = 7
 	CANCEL       Type = 8
+	PORT         Type = 9  // DHT port (BEP 5)
+	HAVE_ALL     Type = 14 // fast extension (BEP 6)
+	HAVE_NONE    Type = 15
+	REJECT       Type = 16
+	EXTENDED     Type = 20 // BEP 10 extension protocol
 )
 
-type Message interface {
-	toBytes() []byte
-}
-
-
-
 func (t Type) String() string {
 	switch t {
 	case CHOKE:
@@ -46,103 +40,51 @@ func (t Type) String() string {
 		return "PIECE"
 	case CANCEL:
 		return "CANCEL"
+	case PORT:
+		return "PORT"
+	case HAVE_ALL:
+		return "HAVE_ALL"
+	case HAVE_NONE:
+		return "HAVE_NONE"
+	case REJECT:
+		return "REJECT_REQUEST"
+	case EXTENDED:
+		return "EXTENDED"
 	default:
 		return "BITTORRENT"
 	}
 }
 
-type PeerMessage struct {
-	lengthPrefix uint32
-	id           uint8
-	index        uint32
-	begin        uint32
-	length       uint32
-}
-
-type HaveMessage struct {
-	LengthPrefix uint32
-	MsgType      Type
-	Index        uint32
-}
-
-func (msg *HaveMessage) toBytes() []byte {
-	var buffer bytes.Buffer
-	binary.Write(&buffer, binary.BigEndian, msg)
-	return buffer.Bytes()
-}
-
 var PREFIX = []byte{0, 0, 0, 1}
 
 type PeerHandshake struct {
 	Prefix   uint32
-	Length   int8   `json:"length"`
-	Protocol string `json:"protocol"`
-	InfoHash string `json:"info_hash"`
-	PeerId   string `json:"peer_id"`
-}
-func NewHandshake(hash []byte)PeerHandshake{
-   	return PeerHandshake{
-		Protocol: "BitTorrent protocol",
-		InfoHash: string(hash),
-		PeerId:   "00112233445566778899",
-	}
-}
-
-type PeerRequest struct {
-	Prefix uint32
-	Type   uint8
-	Index  uint32
-	Begin  uint32
-	Length uint32
+	Length   int8    `json:"length"`
+	Protocol string  `json:"protocol"`
+	Reserved [8]byte `json:"reserved"`
+	InfoHash string  `json:"info_hash"`
+	PeerId   string  `json:"peer_id"`
 }
 
-type PieceResponse struct {
-	Index uint32
-	Begin uint32
-	Block []byte
-}
-type Piece struct {
-	Index            uint32
-	Length           uint32
-	Blocks           [][]byte
-	DownloadedBlocks int
-}
+// Reserved bit telling the peer we support the extension protocol (BEP 10).
+const extensionBit = 0x10
 
-func (p *Piece) IsComplete() bool {
-	return p.DownloadedBlocks == len(p.Blocks)
-}
+// Reserved bit of the last byte for the fast extension (BEP 6).
+const fastBit = 0x04
 
-func NewPiece(index uint32, length uint32) Piece {
-	var blockSize = uint32(16 * 1024)
-	numBlocks := (length + blockSize - 1) / blockSize
-	blocks := make([][]byte, numBlocks)
-	return Piece{
-		Index:            index,
-		Length:           length,
-		Blocks:           blocks,
-		DownloadedBlocks: 0,
-	}
-}
-func (p *Piece) AddBlock(block []byte, blockIndex int) {
-	p.Blocks[blockIndex] = block
-	p.DownloadedBlocks++
+// EnableExtensions advertises support for the extension protocol.
+func (h *PeerHandshake) EnableExtensions() {
+	h.Reserved[5] |= extensionBit
 }
 
-func (p *Piece) ConcatBlocks() []byte {
-	piece := make([]byte, p.Length)
-	offset := 0
-	for _, block := range p.Blocks {
-		copy(piece[offset:], block)
-		offset += len(block)
-	}
-	return piece
+// EnableFast advertises support for the fast extension, HAVE_ALL and HAVE_NONE.
+func (h *PeerHandshake) EnableFast() {
+	h.Reserved[7] |= fastBit
 }
-func BytesToPiece(content []byte) PieceResponse {
-
-	return PieceResponse{
-		Index: binary.BigEndian.Uint32(content[:4]),
-		Begin: binary.BigEndian.Uint32(content[4:8]),
-		Block: content[8:],
+func NewHandshake(hash []byte)PeerHandshake{
+   	return PeerHandshake{
+		Protocol: "BitTorrent protocol",
+		InfoHash: string(hash),
+		PeerId:   defaultPeerId,
 	}
-
 }
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"bittorrent/src/decoder"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Scraper is implemented by the trackers that can be scraped.
+type Scraper interface {
+	// Scrape returns the counters of each info hash, in the same order.
+	Scrape(infoHashes [][]byte) ([]ScrapeResult, error)
+}
+
+/*
+ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL:
+the last path element has to start with "announce", which is replaced by
+"scrape". Trackers that do not follow this convention cannot be scraped.
+*/
+func ScrapeURL(announce string) (string, error) {
+	u, e := url.Parse(announce)
+	if e != nil {
+		return "", e
+	}
+	dir, last := path.Split(u.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// httpScrapeResp is the dictionary sent by HTTP trackers to a scrape.
+type httpScrapeResp struct {
+	Files         map[string]ScrapeFile `bencode:"files"`
+	FailureReason *string               `bencode:"failure reason"`
+}
+
+// ScrapeFile holds the counters of one torrent in an HTTP scrape response.
+type ScrapeFile struct {
+	Complete   int64 `bencode:"complete"`
+	Downloaded int64 `bencode:"downloaded"`
+	Incomplete int64 `bencode:"incomplete"`
+}
+
+/*
+Scrape asks for the counters of all the info hashes in one request.
+Torrents the tracker does not know about are returned with zero counters.
+*/
+func (t *HTTPTracker) Scrape(infoHashes [][]byte) ([]ScrapeResult, error) {
+	scrape, e := ScrapeURL(t.URL)
+	if e != nil {
+		return nil, e
+	}
+	params := url.Values{}
+	for _, hash := range infoHashes {
+		params.Add("info_hash", string(hash))
+	}
+	separator := "?"
+	if strings.Contains(scrape, "?") {
+		separator = "&"
+	}
+
+	resp, e := httpClient.Get(scrape + separator + params.Encode())
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	content, e := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if e != nil {
+		return nil, e
+	}
+
+	var raw httpScrapeResp
+	if e := decoder.Unmarshal(content, &raw); e != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker answered %s", resp.Status)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, e)
+	}
+	if raw.FailureReason != nil {
+		return nil, &FailureError{Reason: *raw.FailureReason}
+	}
+	results := []ScrapeResult{}
+	for _, hash := range infoHashes {
+		file := raw.Files[string(hash)]
+		results = append(results, ScrapeResult{
+			InfoHash:   hash,
+			Complete:   file.Complete,
+			Downloaded: file.Downloaded,
+			Incomplete: file.Incomplete,
+		})
+	}
+	return results, nil
+}
+
+// Scrape scrapes the tracker at announce, chosen by its scheme like NewTracker.
+func Scrape(announce string, infoHashes [][]byte) ([]ScrapeResult, error) {
+	tracker, e := NewTracker(announce)
+	if e != nil {
+		return nil, e
+	}
+	if udp, ok := tracker.(*UDPTracker); ok {
+		defer udp.Close()
+	}
+	scraper, ok := tracker.(Scraper)
+	if !ok {
+		return nil, fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	return scraper.Scrape(infoHashes)
+}
@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Announce intervals used when the tracker does not send one, or fails.
+const (
+	defaultInterval = 30 * time.Minute
+	retryInterval   = time.Minute
+)
+
+/*
+TrackerSession keeps announcing a torrent for as long as it is active: it
+sends started on Start, re-announces every interval (never sooner than min
+interval), completed once the download finishes and stopped on Stop. The
+transfer counters are kept by the caller through AddUploaded, AddDownloaded
+and SetLeft. Peers from every answer are sent to the Peers channel.
+*/
+type TrackerSession struct {
+	// NumWant is the number of peers asked for, 0 lets the tracker decide
+	NumWant int
+
+	tracker  Tracker
+	infoHash []byte
+	port     int
+	key      uint32
+	peers    chan []IP
+
+	// announceMu keeps announces in order
+	announceMu sync.Mutex
+
+	mu          sync.Mutex
+	uploaded    int64
+	downloaded  int64
+	left        int64
+	completed   bool
+	interval    time.Duration
+	minInterval time.Duration
+	last        time.Time
+	// retryIn is the wait asked for by the last failure, if any
+	retryIn time.Duration
+	// started is set by Start, Stop only waits for the re-announce loop then
+	started bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTrackerSession creates a session for infoHash, port 0 uses the default port.
+func NewTrackerSession(tracker Tracker, infoHash []byte, left int64, port int) *TrackerSession {
+	if port == 0 {
+		port = defaultPort
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	return &TrackerSession{
+		tracker:  tracker,
+		infoHash: infoHash,
+		port:     port,
+		key:      binary.BigEndian.Uint32(key[:]),
+		left:     left,
+		peers:    make(chan []IP, 1),
+		interval: defaultInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Peers delivers the peers of every periodic announce.
+func (s *TrackerSession) Peers() <-chan []IP {
+	return s.peers
+}
+
+func (s *TrackerSession) AddUploaded(n int64) {
+	s.mu.Lock()
+	s.uploaded += n
+	s.mu.Unlock()
+}
+
+func (s *TrackerSession) AddDownloaded(n int64) {
+	s.mu.Lock()
+	s.downloaded += n
+	s.mu.Unlock()
+}
+
+func (s *TrackerSession) SetLeft(n int64) {
+	s.mu.Lock()
+	s.left = n
+	s.mu.Unlock()
+}
+
+/*
+Start sends the started event and begins the periodic re-announces.
+The peers of the first answer are returned directly.
+*/
+func (s *TrackerSession) Start() (TrackerResp, error) {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+	resp, e := s.announce(EventStarted)
+	go s.loop(e != nil)
+	return resp, e
+}
+
+/*
+Completed sends the completed event, once, and sets left to zero. It must
+be called when the last piece is verified.
+*/
+func (s *TrackerSession) Completed() error {
+	s.mu.Lock()
+	if s.completed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.completed = true
+	s.left = 0
+	s.mu.Unlock()
+	_, e := s.announce(EventCompleted)
+	return e
+}
+
+/*
+Stop ends the periodic announces and sends the stopped event. A session
+that was never started has nothing to stop.
+*/
+func (s *TrackerSession) Stop() error {
+	select {
+	case <-s.stop:
+		return errors.New("tracker session already stopped")
+	default:
+	}
+	close(s.stop)
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+	<-s.done
+	_, e := s.announce(EventStopped)
+	return e
+}
+
+func (s *TrackerSession) announce(event Event) (TrackerResp, error) {
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+
+	s.mu.Lock()
+	params := AnnounceParams{
+		InfoHash:   s.infoHash,
+		PeerId:     defaultPeerId,
+		Port:       s.port,
+		Uploaded:   s.uploaded,
+		Downloaded: s.downloaded,
+		Left:       s.left,
+		Event:      event,
+		NumWant:    s.NumWant,
+		Key:        s.key,
+	}
+	s.mu.Unlock()
+
+	resp, e := s.tracker.Announce(params)
+	if e != nil {
+		var failure *FailureError
+		s.mu.Lock()
+		s.retryIn = 0
+		if errors.As(e, &failure) {
+			s.retryIn = time.Duration(failure.RetryIn) * time.Second
+		}
+		s.mu.Unlock()
+		return TrackerResp{}, e
+	}
+
+	s.mu.Lock()
+	s.last = time.Now()
+	if resp.Interval > 0 {
+		s.interval = time.Duration(resp.Interval) * time.Second
+	}
+	s.minInterval = time.Duration(resp.MinInterval) * time.Second
+	s.mu.Unlock()
+	return resp, nil
+}
+
+// next returns how long to wait before the next periodic announce.
+func (s *TrackerSession) next(failed bool) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failed {
+		return max(retryInterval, s.minInterval, s.retryIn)
+	}
+	wait := max(s.interval, s.minInterval)
+	// an announce made in between, like completed, restarts the interval
+	return max(time.Until(s.last.Add(wait)), s.minInterval, time.Second)
+}
+
+func (s *TrackerSession) loop(failed bool) {
+	defer close(s.done)
+	for {
+		timer := time.NewTimer(s.next(failed))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		resp, e := s.announce(EventNone)
+		failed = e != nil
+		if failed {
+			log.Println("Announce failed:", e)
+			continue
+		}
+		// drop peers nobody picked up yet in favour of the new ones
+		select {
+		case <-s.peers:
+		default:
+		}
+		s.peers <- resp.Peers
+	}
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracker records the events announced to it.
+type recordingTracker struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (t *recordingTracker) Announce(params AnnounceParams) (TrackerResp, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, params.Event)
+	return TrackerResp{Interval: 1800}, nil
+}
+
+func (t *recordingTracker) announced() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Event{}, t.events...)
+}
+
+// stop calls Stop, failing if it does not return within a second.
+func stop(t *testing.T, s *TrackerSession) error {
+	result := make(chan error, 1)
+	go func() { result <- s.Stop() }()
+	select {
+	case e := <-result:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+		return nil
+	}
+}
+
+func TestTrackerSessionStop(t *testing.T) {
+	tracker := &recordingTracker{}
+	s := NewTrackerSession(tracker, make([]byte, 20), 100, 0)
+	if _, e := s.Start(); e != nil {
+		t.Fatal(e)
+	}
+	if e := s.Completed(); e != nil {
+		t.Fatal(e)
+	}
+	if e := stop(t, s); e != nil {
+		t.Fatal(e)
+	}
+	want := []Event{EventStarted, EventCompleted, EventStopped}
+	if got := tracker.announced(); !slices.Equal(got, want) {
+		t.Errorf("announced %v, want %v", got, want)
+	}
+	if e := stop(t, s); e == nil {
+		t.Error("second Stop succeeded")
+	}
+}
+
+func TestTrackerSessionStopWithoutStart(t *testing.T) {
+	tracker := &recordingTracker{}
+	s := NewTrackerSession(tracker, make([]byte, 20), 100, 0)
+	if e := stop(t, s); e != nil {
+		t.Fatal(e)
+	}
+	if got := tracker.announced(); len(got) != 0 {
+		t.Errorf("announced %v for a session never started", got)
+	}
+}
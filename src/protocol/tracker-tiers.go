@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TierWait is how long Announce waits for the other tiers once one answered.
+var TierWait = 5 * time.Second
+
+/*
+TrackerTiers announces to a multi-tracker list (BEP 12). Trackers are
+shuffled within their tier once, the trackers of a tier are tried in order
+until one answers and that tracker is moved to the front of its tier. The
+tiers are announced to at the same time and their peers merged, so one dead
+tracker does not leave the torrent without peers, nor holds up the others.
+*/
+type TrackerTiers struct {
+	mu      sync.Mutex
+	tiers   [][]string
+	clients map[string]Tracker
+}
+
+func NewTrackerTiers(tiers [][]string) *TrackerTiers {
+	shuffled := make([][]string, 0, len(tiers))
+	for _, tier := range tiers {
+		tier = slices.Clone(tier)
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		shuffled = append(shuffled, tier)
+	}
+	return &TrackerTiers{
+		tiers:   shuffled,
+		clients: make(map[string]Tracker),
+	}
+}
+
+// Tiers returns the current order of the trackers.
+func (t *TrackerTiers) Tiers() [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = slices.Clone(tier)
+	}
+	return tiers
+}
+
+/*
+Announce announces to every tier in parallel and merges the answers: the
+peers without duplicates, the shortest interval and the largest min
+interval and counters. Once a tier answered, the others have TierWait
+more to answer, the late ones are left out.
+It fails only when no tracker at all answered.
+*/
+func (t *TrackerTiers) Announce(params AnnounceParams) (TrackerResp, error) {
+	t.mu.Lock()
+	numTiers := len(t.tiers)
+	t.mu.Unlock()
+	if numTiers == 0 {
+		return TrackerResp{}, errors.New("torrent has no trackers")
+	}
+
+	type answer struct {
+		tier int
+		resp TrackerResp
+		err  error
+	}
+	// buffered so the tiers still announcing after we return do not block
+	answers := make(chan answer, numTiers)
+	for i := range numTiers {
+		go func() {
+			resp, e := t.announceTier(i, params)
+			answers <- answer{i, resp, e}
+		}()
+	}
+
+	responses := make([]*TrackerResp, numTiers)
+	errs := make([]error, numTiers)
+	var deadline <-chan time.Time
+wait:
+	for range numTiers {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				errs[a.tier] = a.err
+				continue
+			}
+			responses[a.tier] = &a.resp
+			if deadline == nil {
+				deadline = time.After(TierWait)
+			}
+		case <-deadline:
+			break wait
+		}
+	}
+
+	merged := TrackerResp{}
+	seen := make(map[string]bool)
+	answered := false
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		if !answered || resp.Interval < merged.Interval {
+			merged.Interval = resp.Interval
+		}
+		answered = true
+		merged.MinInterval = max(merged.MinInterval, resp.MinInterval)
+		merged.Complete = max(merged.Complete, resp.Complete)
+		merged.Incomplete = max(merged.Incomplete, resp.Incomplete)
+		if merged.WarningMessage == "" {
+			merged.WarningMessage = resp.WarningMessage
+		}
+		if merged.ExternalIP == nil {
+			merged.ExternalIP = resp.ExternalIP
+		}
+		for _, peer := range resp.Peers {
+			if !seen[peer.String()] {
+				seen[peer.String()] = true
+				merged.Peers = append(merged.Peers, peer)
+			}
+		}
+	}
+	if !answered {
+		return TrackerResp{}, fmt.Errorf("no tracker answered: %w", errors.Join(errs...))
+	}
+	return merged, nil
+}
+
+// announceTier tries the trackers of a tier in order until one answers.
+func (t *TrackerTiers) announceTier(index int, params AnnounceParams) (TrackerResp, error) {
+	t.mu.Lock()
+	tier := slices.Clone(t.tiers[index])
+	t.mu.Unlock()
+
+	errs := []error{}
+	for _, announce := range tier {
+		client, e := t.client(announce)
+		if e == nil {
+			var resp TrackerResp
+			if resp, e = client.Announce(params); e == nil {
+				t.promote(index, announce)
+				return resp, nil
+			}
+		}
+		log.Printf("Tracker %s: %v\n", announce, e)
+		errs = append(errs, fmt.Errorf("%s: %w", announce, e))
+	}
+	return TrackerResp{}, errors.Join(errs...)
+}
+
+// client returns the tracker client for an URL, keeping it for the next announces.
+func (t *TrackerTiers) client(announce string) (Tracker, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client, ok := t.clients[announce]; ok {
+		return client, nil
+	}
+	client, e := NewTracker(announce)
+	if e != nil {
+		return nil, e
+	}
+	t.clients[announce] = client
+	return client, nil
+}
+
+// promote moves a tracker that answered to the front of its tier.
+func (t *TrackerTiers) promote(index int, announce string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tier := t.tiers[index]
+	i := slices.Index(tier, announce)
+	if i <= 0 {
+		return
+	}
+	copy(tier[1:i+1], tier[:i])
+	tier[0] = announce
+}
@@ -1,45 +1,183 @@
 package protocol
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strconv"
 )
 
+/*
+Peer id sent to trackers and peers, random for each run so that two clients
+on the same host are different peers for trackers.
+*/
+var defaultPeerId = newPeerId()
 
+// Port we announce to trackers.
+const defaultPort = 6881
+
+// newPeerId returns an Azureus style peer id, the client and version then random characters.
+func newPeerId() string {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	id := []byte("-GO0001-000000000000")
+	random := make([]byte, len(id)-8)
+	rand.Read(random)
+	for i, b := range random {
+		id[8+i] = chars[int(b)%len(chars)]
+	}
+	return string(id)
+}
 
 type TrackerResp struct {
-	Complete   int64  `bencode:"complete"`
-	Incomplete int64  `bencode:"incomplete"`
-	Interval   int64  `bencode:"interval"`
-	Peers      []byte `bencode:"peers"`
+	Complete    int64  `bencode:"complete"`
+	Incomplete  int64  `bencode:"incomplete"`
+	Interval    int64  `bencode:"interval"`
+	MinInterval int64  `bencode:"min interval"`
+	TrackerId   string `bencode:"tracker id"`
+	Peers       []IP   `bencode:"-"`
+	// WarningMessage is set when the tracker answered but has something to say
+	WarningMessage string `bencode:"-"`
+	// ExternalIP is our address as seen by the tracker, if it told us
+	ExternalIP net.IP `bencode:"-"`
+}
+
+// ErrInvalidResponse is wrapped by the errors for responses that cannot be parsed.
+var ErrInvalidResponse = errors.New("invalid tracker response")
+
+/*
+FailureError is returned when the tracker refused the request. RetryIn is
+the number of seconds to wait before trying again, 0 if it did not say.
+*/
+type FailureError struct {
+	Reason  string
+	RetryIn int64
+}
+
+func (e *FailureError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+// Event is the announce event, with the values used by UDP trackers.
+type Event int32
+
+const (
+	EventNone      Event = 0
+	EventCompleted Event = 1
+	EventStarted   Event = 2
+	EventStopped   Event = 3
+)
+
+// String returns the event as sent to HTTP trackers.
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type AnnounceParams struct {
+	InfoHash   []byte
+	PeerId     string
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	NumWant    int // 0 lets the tracker decide
+	Key        uint32
+	// TrackerId overrides the id the tracker sent in a previous answer
+	TrackerId string
+}
+
+// ScrapeResult holds the swarm counters a tracker reports for one torrent.
+type ScrapeResult struct {
+	InfoHash   []byte
+	Complete   int64 // seeders
+	Downloaded int64
+	Incomplete int64 // leechers
+}
+
+type Tracker interface {
+	Announce(params AnnounceParams) (TrackerResp, error)
+}
+
+// NewTracker returns the client for the announce URL, chosen by its scheme.
+func NewTracker(announce string) (Tracker, error) {
+	u, e := url.Parse(announce)
+	if e != nil {
+		return nil, e
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &HTTPTracker{URL: announce}, nil
+	case "udp":
+		return NewUDPTracker(announce)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
 }
 
 type IP struct {
 	net.IP
 	Port int
+	// PeerId is only known for peers from a non compact tracker response
+	PeerId string
 }
 
 func (ip IP) String() string {
-	return fmt.Sprintf("%v:%d", ip.IP, ip.Port)
+	return net.JoinHostPort(ip.IP.String(), strconv.Itoa(ip.Port))
 }
 func IPFromStr(ipstr string) (IP, error) {
-	var colonIndex int
-	for i, l := range ipstr {
-		if l == ':' {
-			colonIndex = i
-			break
-		}
+	host, portStr, e := net.SplitHostPort(ipstr)
+	if e != nil {
+		return IP{}, e
+	}
+	port, e := strconv.Atoi(portStr)
+	if e != nil || port <= 0 || port > 65535 {
+		return IP{}, fmt.Errorf("invalid port in %q", ipstr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return IP{}, fmt.Errorf("invalid ip in %q", ipstr)
 	}
-	ip := ipstr[:colonIndex]
-	port, _ := strconv.Atoi(ipstr[colonIndex+1:])
 
 	IP := IP{
-		net.ParseIP(ip),
-		port,
+		IP:   ip,
+		Port: port,
 	}
 	return IP, nil
 }
 
+// parsePeers parses a compact IPv4 peer list, 6 bytes per peer.
+func parsePeers(peers []byte) ([]IP, error) {
+	return parseCompactPeers(peers, net.IPv4len)
+}
 
+// parsePeers6 parses a compact IPv6 peer list, 18 bytes per peer.
+func parsePeers6(peers []byte) ([]IP, error) {
+	return parseCompactPeers(peers, net.IPv6len)
+}
 
+func parseCompactPeers(peers []byte, ipLen int) ([]IP, error) {
+	size := ipLen + 2
+	if len(peers)%size != 0 {
+		return nil, fmt.Errorf("%w: compact peer list length %d is not a multiple of %d", ErrInvalidResponse, len(peers), size)
+	}
+	ips := make([]IP, 0, len(peers)/size)
+	for start := 0; start < len(peers); start += size {
+		peer := peers[start : start+size]
+		ips = append(ips, IP{
+			IP:   net.IP(append([]byte{}, peer[:ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(peer[ipLen:])),
+		})
+	}
+	return ips, nil
+}
@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15), shared with the tracker server
+const (
+	UDPProtocolId = 0x41727101980
+
+	UDPActionConnect  = 0
+	UDPActionAnnounce = 1
+	UDPActionScrape   = 2
+	UDPActionError    = 3
+
+	// scrape requests hold at most this many info hashes
+	UDPMaxScrapeHashes = 74
+)
+
+const (
+	// a connection id can be used for one minute after it was received
+	udpConnectionIdLifetime = time.Minute
+	// the largest UDP payload, announce responses grow with the number of peers
+	udpMaxPacketSize = 65507
+)
+
+/*
+UDPTracker talks to a udp:// tracker. Requests are retransmitted after
+Timeout·2^n for n up to MaxRetries. BEP 15 sets them to 15 seconds and 8,
+over 2 hours for a dead tracker, so MaxRetries defaults to 2 and a tracker
+gives up after 105 seconds.
+*/
+type UDPTracker struct {
+	Addr       string
+	Timeout    time.Duration
+	MaxRetries int
+
+	mu         sync.Mutex
+	conn       net.Conn
+	connId     uint64
+	connIdTime time.Time
+}
+
+func NewUDPTracker(announce string) (*UDPTracker, error) {
+	u, e := url.Parse(announce)
+	if e != nil {
+		return nil, e
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return nil, fmt.Errorf("invalid udp tracker %q", announce)
+	}
+	return &UDPTracker{
+		Addr:       u.Host,
+		Timeout:    15 * time.Second,
+		MaxRetries: 2,
+	}, nil
+}
+
+func (t *UDPTracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	e := t.conn.Close()
+	t.conn = nil
+	return e
+}
+
+func (t *UDPTracker) Announce(p AnnounceParams) (TrackerResp, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	numWant := int32(-1)
+	if p.NumWant > 0 {
+		numWant = int32(p.NumWant)
+	}
+	body := make([]byte, 0, 82)
+	body = append(body, p.InfoHash...)
+	body = append(body, p.PeerId...)
+	body = binary.BigEndian.AppendUint64(body, uint64(p.Downloaded))
+	body = binary.BigEndian.AppendUint64(body, uint64(p.Left))
+	body = binary.BigEndian.AppendUint64(body, uint64(p.Uploaded))
+	body = binary.BigEndian.AppendUint32(body, uint32(p.Event))
+	body = binary.BigEndian.AppendUint32(body, 0) // ip, let the tracker use the sender address
+	body = binary.BigEndian.AppendUint32(body, p.Key)
+	body = binary.BigEndian.AppendUint32(body, uint32(numWant))
+	body = binary.BigEndian.AppendUint16(body, uint16(p.Port))
+
+	resp, e := t.request(UDPActionAnnounce, body)
+	if e != nil {
+		return TrackerResp{}, e
+	}
+	if len(resp) < 12 {
+		return TrackerResp{}, errors.New("udp tracker: short announce response")
+	}
+	peers := resp[12:]
+	var ips []IP
+	// peers come in the address family of the tracker
+	if t.isIPv6() {
+		ips, e = parsePeers6(peers)
+	} else {
+		ips, e = parsePeers(peers)
+	}
+	if e != nil {
+		return TrackerResp{}, e
+	}
+	return TrackerResp{
+		Interval:   int64(binary.BigEndian.Uint32(resp[0:4])),
+		Incomplete: int64(binary.BigEndian.Uint32(resp[4:8])),
+		Complete:   int64(binary.BigEndian.Uint32(resp[8:12])),
+		Peers:      ips,
+	}, nil
+}
+
+// Scrape asks for the counters of each info hash, in the same order.
+func (t *UDPTracker) Scrape(infoHashes [][]byte) ([]ScrapeResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	results := []ScrapeResult{}
+	for start := 0; start < len(infoHashes); start += UDPMaxScrapeHashes {
+		batch := infoHashes[start:min(start+UDPMaxScrapeHashes, len(infoHashes))]
+		body := []byte{}
+		for _, hash := range batch {
+			body = append(body, hash...)
+		}
+		resp, e := t.request(UDPActionScrape, body)
+		if e != nil {
+			return nil, e
+		}
+		if len(resp) < 12*len(batch) {
+			return nil, errors.New("udp tracker: short scrape response")
+		}
+		for i, hash := range batch {
+			entry := resp[12*i:]
+			results = append(results, ScrapeResult{
+				InfoHash:   hash,
+				Complete:   int64(binary.BigEndian.Uint32(entry[0:4])),
+				Downloaded: int64(binary.BigEndian.Uint32(entry[4:8])),
+				Incomplete: int64(binary.BigEndian.Uint32(entry[8:12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+func (t *UDPTracker) isIPv6() bool {
+	addr, ok := t.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+func (t *UDPTracker) dial() error {
+	if t.conn != nil {
+		return nil
+	}
+	conn, e := net.Dial("udp", t.Addr)
+	if e != nil {
+		return e
+	}
+	t.conn = conn
+	return nil
+}
+
+/*
+request sends an action with a valid connection id and returns the response
+after the action and transaction id. The connection id is refreshed when
+it expires, including between retransmissions.
+*/
+func (t *UDPTracker) request(action uint32, body []byte) ([]byte, error) {
+	if e := t.dial(); e != nil {
+		return nil, e
+	}
+	for n := 0; n <= t.MaxRetries; n++ {
+		timeout := t.Timeout << n
+		if time.Since(t.connIdTime) > udpConnectionIdLifetime {
+			if e := t.connect(timeout); e != nil {
+				if isTimeout(e) {
+					continue
+				}
+				return nil, e
+			}
+		}
+		packet := binary.BigEndian.AppendUint64(nil, t.connId)
+		resp, e := t.roundTrip(packet, action, body, timeout)
+		if isTimeout(e) {
+			continue
+		}
+		return resp, e
+	}
+	return nil, errors.New("udp tracker: no response")
+}
+
+// connect gets a new connection id, making a single attempt.
+func (t *UDPTracker) connect(timeout time.Duration) error {
+	packet := binary.BigEndian.AppendUint64(nil, UDPProtocolId)
+	resp, e := t.roundTrip(packet, UDPActionConnect, nil, timeout)
+	if e != nil {
+		return e
+	}
+	if len(resp) < 8 {
+		return errors.New("udp tracker: short connect response")
+	}
+	t.connId = binary.BigEndian.Uint64(resp)
+	t.connIdTime = time.Now()
+	return nil
+}
+
+/*
+roundTrip sends prefix, action, a new transaction id and body, then waits
+until timeout for the response with the same transaction id. Datagrams for
+other transactions are dropped.
+*/
+func (t *UDPTracker) roundTrip(prefix []byte, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	var txBytes [4]byte
+	if _, e := rand.Read(txBytes[:]); e != nil {
+		return nil, e
+	}
+	transactionId := binary.BigEndian.Uint32(txBytes[:])
+
+	packet := binary.BigEndian.AppendUint32(prefix, action)
+	packet = binary.BigEndian.AppendUint32(packet, transactionId)
+	packet = append(packet, body...)
+	if _, e := t.conn.Write(packet); e != nil {
+		return nil, e
+	}
+
+	t.conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		n, e := t.conn.Read(buffer)
+		if e != nil {
+			return nil, e
+		}
+		if n < 8 || binary.BigEndian.Uint32(buffer[4:8]) != transactionId {
+			continue
+		}
+		respAction := binary.BigEndian.Uint32(buffer[0:4])
+		if respAction == UDPActionError {
+			return nil, &FailureError{Reason: string(buffer[8:n])}
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("udp tracker: expected action %d, got %d", action, respAction)
+		}
+		return append([]byte{}, buffer[8:n]...), nil
+	}
+}
+
+func isTimeout(e error) bool {
+	var netErr net.Error
+	return errors.As(e, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,252 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const standInConnId = 0x1122334455667788
+
+/*
+standInTracker is a local UDP tracker answering connect, announce and
+scrape. It can drop the first packets it gets and answer each request with
+a wrong transaction id before the right one.
+*/
+type standInTracker struct {
+	conn    net.PacketConn
+	wrongTx bool
+	// peers is the number of peers sent in announce responses, 0 sends 2
+	peers int
+
+	mu sync.Mutex
+	// drop is the number of packets to ignore before answering
+	drop    int
+	actions []uint32
+}
+
+func newStandInTracker(t *testing.T) *standInTracker {
+	conn, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &standInTracker{conn: conn}
+}
+
+// client returns a tracker client for the stand-in with a short timeout.
+func (s *standInTracker) client(t *testing.T) *UDPTracker {
+	tracker, e := NewUDPTracker("udp://" + s.conn.LocalAddr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	tracker.Timeout = 50 * time.Millisecond
+	t.Cleanup(func() { tracker.Close() })
+	return tracker
+}
+
+// received returns the actions of the packets answered, in order.
+func (s *standInTracker) received() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32{}, s.actions...)
+}
+
+func (s *standInTracker) serve(t *testing.T) {
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, e := s.conn.ReadFrom(buffer)
+		if e != nil {
+			return
+		}
+		s.mu.Lock()
+		dropped := s.drop > 0
+		if dropped {
+			s.drop--
+		}
+		s.mu.Unlock()
+		if dropped {
+			continue
+		}
+		packet := buffer[:n]
+		if n < 16 {
+			t.Errorf("packet of %d bytes", n)
+			continue
+		}
+		connId := binary.BigEndian.Uint64(packet[0:8])
+		action := binary.BigEndian.Uint32(packet[8:12])
+		tx := binary.BigEndian.Uint32(packet[12:16])
+		body := packet[16:]
+		s.mu.Lock()
+		s.actions = append(s.actions, action)
+		s.mu.Unlock()
+
+		resp := binary.BigEndian.AppendUint32(nil, action)
+		switch action {
+		case UDPActionConnect:
+			if connId != UDPProtocolId {
+				t.Errorf("connect with protocol id %x", connId)
+			}
+			resp = binary.BigEndian.AppendUint32(resp, tx)
+			resp = binary.BigEndian.AppendUint64(resp, standInConnId)
+		case UDPActionAnnounce:
+			if connId != standInConnId || len(body) != 82 {
+				t.Errorf("announce with connection id %x and %d bytes", connId, len(body))
+			}
+			resp = binary.BigEndian.AppendUint32(resp, tx)
+			resp = binary.BigEndian.AppendUint32(resp, 1800) // interval
+			resp = binary.BigEndian.AppendUint32(resp, 3)    // leechers
+			resp = binary.BigEndian.AppendUint32(resp, 5)    // seeders
+			if s.peers == 0 {
+				resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+			}
+			for i := range s.peers {
+				resp = append(resp, 10, 1, byte(i>>8), byte(i), 0x1a, 0xe1)
+			}
+		case UDPActionScrape:
+			resp = binary.BigEndian.AppendUint32(resp, tx)
+			for i := range len(body) / 20 {
+				resp = binary.BigEndian.AppendUint32(resp, uint32(10*i+5)) // seeders
+				resp = binary.BigEndian.AppendUint32(resp, uint32(10*i+7)) // completed
+				resp = binary.BigEndian.AppendUint32(resp, uint32(10*i+3)) // leechers
+			}
+		}
+		if s.wrongTx {
+			wrong := bytes.Clone(resp)
+			binary.BigEndian.PutUint32(wrong[4:8], tx+1)
+			// the error would fail the request if the client read it
+			binary.BigEndian.PutUint32(wrong[0:4], UDPActionError)
+			s.conn.WriteTo(append(wrong[:8], "wrong transaction"...), addr)
+		}
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+func announceParams() AnnounceParams {
+	return AnnounceParams{
+		InfoHash: bytes.Repeat([]byte{1}, 20),
+		PeerId:   "-GO0001-abcdefghijkl",
+		Port:     6881,
+		Left:     100,
+		Event:    EventStarted,
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	s := newStandInTracker(t)
+	go s.serve(t)
+	tracker := s.client(t)
+
+	resp, e := tracker.Announce(announceParams())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Interval != 1800 || resp.Incomplete != 3 || resp.Complete != 5 {
+		t.Errorf("announce response %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("peers %v", resp.Peers)
+	}
+
+	// the connection id is still valid, so the second announce does not connect
+	if _, e := tracker.Announce(announceParams()); e != nil {
+		t.Fatal(e)
+	}
+	want := []uint32{UDPActionConnect, UDPActionAnnounce, UDPActionAnnounce}
+	if got := s.received(); !slices.Equal(got, want) {
+		t.Errorf("tracker got actions %v, want %v", got, want)
+	}
+}
+
+func TestUDPTrackerLargeAnnounce(t *testing.T) {
+	s := newStandInTracker(t)
+	s.peers = 2000
+	go s.serve(t)
+	tracker := s.client(t)
+
+	resp, e := tracker.Announce(announceParams())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(resp.Peers) != s.peers || resp.Peers[s.peers-1].String() != "10.1.7.207:6881" {
+		t.Errorf("got %d peers, want %d", len(resp.Peers), s.peers)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	s := newStandInTracker(t)
+	go s.serve(t)
+	tracker := s.client(t)
+
+	hashes := [][]byte{bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)}
+	results, e := tracker.Scrape(hashes)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d scrape results, want 2", len(results))
+	}
+	for i, r := range results {
+		if !bytes.Equal(r.InfoHash, hashes[i]) || r.Complete != int64(10*i+5) || r.Downloaded != int64(10*i+7) || r.Incomplete != int64(10*i+3) {
+			t.Errorf("scrape result %d: %+v", i, r)
+		}
+	}
+}
+
+func TestUDPTrackerIgnoresOtherTransactions(t *testing.T) {
+	s := newStandInTracker(t)
+	s.wrongTx = true
+	go s.serve(t)
+	tracker := s.client(t)
+
+	resp, e := tracker.Announce(announceParams())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(resp.Peers) != 2 {
+		t.Errorf("peers %v", resp.Peers)
+	}
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	s := newStandInTracker(t)
+	// the first connect is lost, then the announce of the second Announce
+	s.drop = 1
+	go s.serve(t)
+	tracker := s.client(t)
+
+	if _, e := tracker.Announce(announceParams()); e != nil {
+		t.Fatal(e)
+	}
+	s.mu.Lock()
+	s.drop = 1
+	s.mu.Unlock()
+	if _, e := tracker.Announce(announceParams()); e != nil {
+		t.Fatal(e)
+	}
+	want := []uint32{UDPActionConnect, UDPActionAnnounce, UDPActionAnnounce}
+	if got := s.received(); !slices.Equal(got, want) {
+		t.Errorf("tracker answered actions %v, want %v", got, want)
+	}
+}
+
+func TestUDPTrackerGivesUp(t *testing.T) {
+	s := newStandInTracker(t)
+	s.drop = 1 << 30
+	go s.serve(t)
+	tracker := s.client(t)
+	tracker.MaxRetries = 1
+
+	start := time.Now()
+	if _, e := tracker.Announce(announceParams()); e == nil {
+		t.Fatal("announce to a tracker that never answers succeeded")
+	}
+	// 50ms then 100ms
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+}
@@ -0,0 +1,212 @@
+package seed
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The choker runs every RechokeInterval and moves the optimistic unchoke every
+optimisticRounds runs. Peers we want blocks from that sent none for
+SnubTimeout are snubbed: only the optimistic unchoke may pick them.
+*/
+const (
+	RechokeInterval  = 10 * time.Second
+	SnubTimeout      = time.Minute
+	optimisticRounds = 3
+	// newPeerTime is how long a peer counts as new, new peers are 3 times as likely to get the optimistic unchoke
+	newPeerTime = time.Minute
+)
+
+type chokeState struct {
+	// uploaded at the last run, for the upload rate
+	uploaded   int64
+	uploadRate float64
+}
+
+/*
+Choker decides which peers we upload to, tit-for-tat: the interested peers
+that upload the most to us get the slots, or the ones that download the
+most from us for torrents we seed. One slot is an optimistic unchoke that
+lets other peers prove themselves.
+*/
+type Choker struct {
+	// Slots is the number of peers unchoked at once, the optimistic one included
+	Slots int
+
+	mu         sync.Mutex
+	peers      map[*Upload]*chokeState
+	optimistic *Upload
+	round      int
+	sampled    time.Time
+	interest   chan struct{}
+}
+
+// NewChoker creates a choker with slots upload slots, 0 uses 4.
+func NewChoker(slots int) *Choker {
+	if slots <= 0 {
+		slots = 4
+	}
+	return &Choker{
+		Slots:    slots,
+		peers:    make(map[*Upload]*chokeState),
+		sampled:  time.Now(),
+		interest: make(chan struct{}, 1),
+	}
+}
+
+// Add puts a peer under the choker, it stays choked until a run unchokes it.
+func (c *Choker) Add(u *Upload) {
+	c.mu.Lock()
+	c.peers[u] = &chokeState{uploaded: u.Uploaded()}
+	c.mu.Unlock()
+	c.Interest()
+}
+
+// Remove forgets a peer that left, its slot goes to another one.
+func (c *Choker) Remove(u *Upload) {
+	c.mu.Lock()
+	delete(c.peers, u)
+	if c.optimistic == u {
+		c.optimistic = nil
+	}
+	c.mu.Unlock()
+	c.Interest()
+}
+
+// Interest asks for a run soon, because a peer became interested or not.
+func (c *Choker) Interest() {
+	select {
+	case c.interest <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Run chokes and unchokes peers every RechokeInterval until done is closed.
+Changes of interest only fill or free slots, the rates and the optimistic
+unchoke move on the regular runs.
+*/
+func (c *Choker) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.rechoke(true)
+		case <-c.interest:
+			c.rechoke(false)
+		}
+	}
+}
+
+func (c *Choker) rechoke(regular bool) {
+	c.mu.Lock()
+	now := time.Now()
+	if regular {
+		elapsed := now.Sub(c.sampled).Seconds()
+		for u, state := range c.peers {
+			uploaded := u.Uploaded()
+			state.uploadRate = float64(uploaded-state.uploaded) / elapsed
+			state.uploaded = uploaded
+		}
+		c.sampled = now
+		c.round++
+	}
+
+	interested := []*Upload{}
+	candidates := []*Upload{}
+	rates := map[*Upload]float64{}
+	for u, state := range c.peers {
+		if !u.conn.State().PeerInterested {
+			continue
+		}
+		interested = append(interested, u)
+		if u.t.seeding() {
+			rates[u] = state.uploadRate
+		} else if !snubbed(u, now) {
+			rates[u] = u.conn.DownloadRate()
+		} else {
+			continue
+		}
+		candidates = append(candidates, u)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return rates[candidates[i]] > rates[candidates[j]]
+	})
+
+	unchoked := map[*Upload]bool{}
+	for _, u := range candidates[:min(c.Slots-1, len(candidates))] {
+		unchoked[u] = true
+	}
+	optimistic := c.optimistic
+	if optimistic != nil && (!optimistic.conn.State().PeerInterested || unchoked[optimistic]) {
+		optimistic = nil
+	}
+	if optimistic == nil || (regular && c.round%optimisticRounds == 0) {
+		optimistic = pickOptimistic(interested, unchoked, now)
+	}
+	c.optimistic = optimistic
+	if optimistic != nil {
+		unchoked[optimistic] = true
+	} else if len(candidates) >= c.Slots {
+		// nobody to try, the slot goes to the next best peer
+		unchoked[candidates[c.Slots-1]] = true
+	}
+
+	peers := []*Upload{}
+	for u := range c.peers {
+		peers = append(peers, u)
+	}
+	c.mu.Unlock()
+	for _, u := range peers {
+		u.SetChoking(!unchoked[u])
+	}
+}
+
+// snubbed tells if we want blocks from the peer and it sent none for SnubTimeout.
+func snubbed(u *Upload, now time.Time) bool {
+	if !u.conn.State().AmInterested {
+		return false
+	}
+	last := u.conn.LastBlock()
+	if last.Before(u.connected) {
+		last = u.connected
+	}
+	return now.Sub(last) > SnubTimeout
+}
+
+// pickOptimistic picks a random interested peer that is not unchoked, new peers being more likely.
+func pickOptimistic(interested []*Upload, unchoked map[*Upload]bool, now time.Time) *Upload {
+	weights := 0
+	choices := []*Upload{}
+	for _, u := range interested {
+		if unchoked[u] {
+			continue
+		}
+		choices = append(choices, u)
+		weights += optimisticWeight(u, now)
+	}
+	if len(choices) == 0 {
+		return nil
+	}
+	n := rand.IntN(weights)
+	for _, u := range choices {
+		n -= optimisticWeight(u, now)
+		if n < 0 {
+			return u
+		}
+	}
+	return choices[len(choices)-1]
+}
+
+func optimisticWeight(u *Upload, now time.Time) int {
+	if now.Sub(u.connected) < newPeerTime {
+		return 3
+	}
+	return 1
+}
@@ -0,0 +1,176 @@
+package seed
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxBlockLength is the largest block a peer may request, larger requests end the connection.
+const MaxBlockLength = 128 * 1024
+
+// HandshakeTimeout bounds the wait for the handshake of a peer that connected.
+var HandshakeTimeout = 20 * time.Second
+
+var ErrUnknownTorrent = errors.New("unknown info hash")
+
+// Torrent is a torrent the server shares.
+type Torrent struct {
+	Info     decoder.Info
+	InfoHash []byte
+	// Have returns the pieces we can send, nil when we have all of them
+	Have func() protocol.Bitfield
+	// ReadBlock fills data with the bytes of piece index from begin
+	ReadBlock func(index int, begin int, data []byte) error
+	// Session, when not nil, gets the bytes uploaded
+	Session *protocol.TrackerSession
+}
+
+// have returns the pieces we can send.
+func (t *Torrent) have() protocol.Bitfield {
+	if t.Have == nil {
+		return protocol.FullBitfield(t.Info.NumPieces())
+	}
+	return t.Have()
+}
+
+// seeding tells if we have every piece.
+func (t *Torrent) seeding() bool {
+	return t.have().Count() == t.Info.NumPieces()
+}
+
+/*
+Server accepts peers and serves the blocks of the torrents added to it,
+up to MaxPeers at once. The choker decides which peers get blocks.
+*/
+type Server struct {
+	// MaxPeers is the number of peers served at once, 0 uses 50
+	MaxPeers int
+
+	choker   *Choker
+	mu       sync.Mutex
+	torrents map[string]*Torrent
+	peers    map[*Upload]bool
+}
+
+// NewServer creates a server whose peers are unchoked by choker, which the caller runs.
+func NewServer(choker *Choker) *Server {
+	return &Server{
+		choker:   choker,
+		torrents: make(map[string]*Torrent),
+		peers:    make(map[*Upload]bool),
+	}
+}
+
+// Add shares a torrent, replacing the one with the same info hash.
+func (s *Server) Add(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[string(t.InfoHash)] = t
+}
+
+// Remove stops sharing a torrent and disconnects its peers.
+func (s *Server) Remove(infoHash []byte) {
+	s.mu.Lock()
+	delete(s.torrents, string(infoHash))
+	peers := []*Upload{}
+	for u := range s.peers {
+		if string(u.t.InfoHash) == string(infoHash) {
+			peers = append(peers, u)
+		}
+	}
+	s.mu.Unlock()
+	for _, u := range peers {
+		u.conn.Close()
+	}
+}
+
+// SendHave tells the peers of a torrent that we have a new piece.
+func (s *Server) SendHave(infoHash []byte, index int) {
+	s.mu.Lock()
+	peers := []*Upload{}
+	for u := range s.peers {
+		if string(u.t.InfoHash) == string(infoHash) {
+			peers = append(peers, u)
+		}
+	}
+	s.mu.Unlock()
+	for _, u := range peers {
+		u.conn.SendHave(uint32(index))
+	}
+}
+
+func (s *Server) torrent(infoHash []byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[string(infoHash)]
+}
+
+// ListenAndServe listens on the TCP address and calls Serve.
+func (s *Server) ListenAndServe(address string) error {
+	l, e := net.Listen("tcp", address)
+	if e != nil {
+		return e
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails, each one on its own goroutine.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		con, e := l.Accept()
+		if e != nil {
+			return e
+		}
+		go s.handle(con)
+	}
+}
+
+func (s *Server) handle(con net.Conn) {
+	maxPeers := s.MaxPeers
+	if maxPeers <= 0 {
+		maxPeers = 50
+	}
+	s.mu.Lock()
+	full := len(s.peers) >= maxPeers
+	s.mu.Unlock()
+	if full {
+		con.Close()
+		return
+	}
+
+	conn := protocol.NewConnection(con)
+	var t *Torrent
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	_, e := conn.AcceptHandshake(func(infoHash []byte) (protocol.PeerHandshake, error) {
+		t = s.torrent(infoHash)
+		if t == nil {
+			return protocol.PeerHandshake{}, ErrUnknownTorrent
+		}
+		handshake := protocol.NewHandshake(infoHash)
+		handshake.EnableFast()
+		return handshake, nil
+	})
+	if e != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	u := NewUpload(t, conn)
+	s.mu.Lock()
+	s.peers[u] = true
+	s.mu.Unlock()
+	if e := u.serve(s.choker); e != nil && e != io.EOF {
+		log.Printf("Peer %s: %v\n", conn.RemoteAddr(), e)
+	}
+	s.mu.Lock()
+	delete(s.peers, u)
+	s.mu.Unlock()
+}
@@ -0,0 +1,209 @@
+package seed
+
+import (
+	"bittorrent/src/protocol"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// keepAliveInterval is how often an idle connection gets a KEEP_ALIVE, peers drop us after 2 minutes.
+const keepAliveInterval = 90 * time.Second
+
+/*
+Upload is the upload side of a connection: it tells the peer our pieces
+and answers its requests while the choker unchokes it. Requests are queued
+and sent by their own goroutine, so a CANCEL can still remove the ones not
+sent yet.
+*/
+type Upload struct {
+	t    *Torrent
+	conn *protocol.Connection
+	// connected is when the upload started, the choker favours new peers
+	connected time.Time
+
+	mu       sync.Mutex
+	queue    []protocol.Request
+	uploaded int64
+	closed   bool
+	wake     chan struct{}
+}
+
+func NewUpload(t *Torrent, conn *protocol.Connection) *Upload {
+	return &Upload{t: t, conn: conn, connected: time.Now(), wake: make(chan struct{}, 1)}
+}
+
+/*
+Start sends our pieces to the peer, it must come right after the
+handshake. Events of the connection must then be passed to Handle.
+*/
+func (u *Upload) Start() error {
+	numPieces := u.t.Info.NumPieces()
+	have := u.t.have()
+	var first protocol.Message = protocol.Bitfield(have)
+	switch {
+	case u.conn.SupportsFast() && have.Count() == numPieces:
+		first = protocol.HaveAll{}
+	case u.conn.SupportsFast() && have.Count() == 0:
+		first = protocol.HaveNone{}
+	case have.Count() == 0:
+		// a peer with no piece may skip the bitfield
+		first = nil
+	}
+	if first != nil {
+		if e := u.conn.WriteMessage(first); e != nil {
+			return e
+		}
+	}
+	go u.sendLoop()
+	return nil
+}
+
+// Close stops sending blocks, the connection is left open.
+func (u *Upload) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.closed {
+		u.closed = true
+		close(u.wake)
+	}
+}
+
+// Uploaded returns the bytes of blocks sent to the peer.
+func (u *Upload) Uploaded() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.uploaded
+}
+
+// Handle applies an event of the connection, other events are ignored.
+func (u *Upload) Handle(event protocol.PeerEvent) error {
+	switch event.Type {
+	case protocol.BlockRequested:
+		request := event.Message.(protocol.Request)
+		if e := u.validate(request); e != nil {
+			return e
+		}
+		u.mu.Lock()
+		if !u.closed && !slices.Contains(u.queue, request) {
+			u.queue = append(u.queue, request)
+			select {
+			case u.wake <- struct{}{}:
+			default:
+			}
+		}
+		u.mu.Unlock()
+	case protocol.RequestCancelled:
+		cancel := protocol.Request(event.Message.(protocol.Cancel))
+		u.mu.Lock()
+		u.queue = slices.DeleteFunc(u.queue, func(r protocol.Request) bool { return r == cancel })
+		u.mu.Unlock()
+	}
+	return nil
+}
+
+// SetChoking chokes or unchokes the peer, choking rejects the requests not sent yet.
+func (u *Upload) SetChoking(choking bool) error {
+	if e := u.conn.SetChoking(choking); e != nil || !choking {
+		return e
+	}
+	u.mu.Lock()
+	dropped := u.queue
+	u.queue = nil
+	u.mu.Unlock()
+	for _, r := range dropped {
+		if e := u.conn.Reject(r); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// validate checks that a request is for a block of a piece we have.
+func (u *Upload) validate(r protocol.Request) error {
+	index := int(r.Index)
+	if index >= u.t.Info.NumPieces() || !u.t.have().Has(index) {
+		return fmt.Errorf("request for piece %d we do not have", index)
+	}
+	if r.Length == 0 || r.Length > MaxBlockLength || int(r.Begin)+int(r.Length) > u.t.Info.PieceSize(index) {
+		return fmt.Errorf("invalid request of %d bytes at %d of piece %d", r.Length, r.Begin, index)
+	}
+	return nil
+}
+
+// sendLoop sends the queued blocks in order until Close.
+func (u *Upload) sendLoop() {
+	for {
+		u.mu.Lock()
+		if len(u.queue) == 0 {
+			u.mu.Unlock()
+			if _, ok := <-u.wake; !ok {
+				return
+			}
+			continue
+		}
+		r := u.queue[0]
+		u.queue = u.queue[1:]
+		u.mu.Unlock()
+
+		if u.conn.State().AmChoking {
+			// queued just before the choke
+			if e := u.conn.Reject(r); e != nil {
+				return
+			}
+			continue
+		}
+		block := make([]byte, r.Length)
+		if e := u.t.ReadBlock(int(r.Index), int(r.Begin), block); e != nil {
+			u.conn.Close()
+			return
+		}
+		if e := u.conn.WriteMessage(protocol.Piece{Index: r.Index, Begin: r.Begin, Block: block}); e != nil {
+			return
+		}
+		u.mu.Lock()
+		u.uploaded += int64(len(block))
+		u.mu.Unlock()
+		if u.t.Session != nil {
+			u.t.Session.AddUploaded(int64(len(block)))
+		}
+	}
+}
+
+// serve runs an inbound connection, which only uploads, until the peer leaves.
+func (u *Upload) serve(choker *Choker) error {
+	defer u.conn.Close()
+	u.conn.TrackPieces(u.t.Info.NumPieces(), nil)
+	if e := u.Start(); e != nil {
+		return e
+	}
+	defer u.Close()
+	choker.Add(u)
+	defer choker.Remove(u)
+
+	events := u.conn.Start()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-keepAlive.C:
+			if e := u.conn.WriteMessage(protocol.KeepAlive{}); e != nil {
+				return e
+			}
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			switch event.Type {
+			case protocol.PeerClosed:
+				return event.Err
+			case protocol.PeerInterested, protocol.PeerNotInterested:
+				choker.Interest()
+			}
+			if e := u.Handle(event); e != nil {
+				return e
+			}
+		}
+	}
+}
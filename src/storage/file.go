@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bittorrent/src/decoder"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Allocation tells how the files of a new storage get their size.
+type Allocation int
+
+const (
+	// Sparse files take disk space as pieces are written
+	Sparse Allocation = iota
+	// Preallocate reserves the space of every file up front, so the disk cannot fill up halfway
+	Preallocate
+)
+
+/*
+Files stores the torrent in its files, kept open until Close. A single file
+torrent is stored at path, a multi file torrent in a directory named after
+the torrent inside path.
+*/
+type Files struct {
+	completion
+	info   decoder.Info
+	layout decoder.Layout
+	files  []*os.File // nil for padding files
+}
+
+/*
+Paths returns where each file of the layout is stored under path, padding
+files included though they are never created.
+*/
+func Paths(path string, info decoder.Info) []string {
+	layout := info.Layout()
+	if !info.IsMultiFile() {
+		return []string{path}
+	}
+	paths := make([]string, len(layout))
+	for i, f := range layout {
+		paths[i] = filepath.Join(path, f.RelPath())
+	}
+	return paths
+}
+
+/*
+NewFiles creates the files of the torrent under path, with their final size.
+Files already there keep their data, so a download can go on.
+*/
+func NewFiles(path string, info decoder.Info, allocation Allocation) (*Files, error) {
+	return openFiles(path, info, os.O_RDWR|os.O_CREATE, func(file *os.File, size int64) error {
+		if allocation == Preallocate {
+			if e := preallocate(file, size); e != nil {
+				return e
+			}
+		}
+		return file.Truncate(size)
+	})
+}
+
+// OpenFiles opens the files of a torrent already under path for reading, such as to seed it.
+func OpenFiles(path string, info decoder.Info) (*Files, error) {
+	return openFiles(path, info, os.O_RDONLY, nil)
+}
+
+func openFiles(path string, info decoder.Info, flag int, resize func(*os.File, int64) error) (*Files, error) {
+	s := &Files{
+		completion: newCompletion(info),
+		info:       info,
+		layout:     info.Layout(),
+	}
+	s.files = make([]*os.File, len(s.layout))
+	for i, path := range Paths(path, info) {
+		f := s.layout[i]
+		if f.IsPadding() {
+			continue
+		}
+		if flag&os.O_CREATE != 0 {
+			if e := os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+				s.Close()
+				return nil, e
+			}
+		}
+		file, e := os.OpenFile(path, flag, 0644)
+		if e != nil {
+			s.Close()
+			return nil, e
+		}
+		s.files[i] = file
+		if resize != nil {
+			if e := resize(file, int64(f.Length)); e != nil {
+				s.Close()
+				return nil, e
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *Files) ReadAt(index int, begin int, data []byte) error {
+	parts, e := spans(s.info, s.layout, index, begin, data)
+	if e != nil {
+		return e
+	}
+	for _, part := range parts {
+		if part.padding {
+			clear(part.data)
+			continue
+		}
+		if _, e := s.files[part.file].ReadAt(part.data, part.offset); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Files) WriteAt(index int, begin int, data []byte) error {
+	parts, e := spans(s.info, s.layout, index, begin, data)
+	if e != nil {
+		return e
+	}
+	for _, part := range parts {
+		if part.padding {
+			continue
+		}
+		if _, e := s.files[part.file].WriteAt(part.data, part.offset); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Files) Close() error {
+	errs := []error{}
+	for _, file := range s.files {
+		if file != nil {
+			errs = append(errs, file.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"bittorrent/src/decoder"
+	"fmt"
+)
+
+/*
+Memory keeps the torrent data in memory, for tests and small torrents.
+Padding files are never written, so they read as zeros like on disk.
+*/
+type Memory struct {
+	completion
+	info   decoder.Info
+	layout decoder.Layout
+	data   []byte
+}
+
+func NewMemory(info decoder.Info) *Memory {
+	return &Memory{
+		completion: newCompletion(info),
+		info:       info,
+		layout:     info.Layout(),
+		data:       make([]byte, info.TotalLength()),
+	}
+}
+
+// piece returns the bytes of a range of a piece.
+func (m *Memory) piece(index int, begin int, length int) ([]byte, error) {
+	if index < 0 || index >= m.info.NumPieces() || begin < 0 || begin+length > m.info.PieceSize(index) {
+		return nil, fmt.Errorf("%d bytes at %d out of piece %d", length, begin, index)
+	}
+	offset := index*m.info.PieceLength + begin
+	return m.data[offset : offset+length], nil
+}
+
+func (m *Memory) ReadAt(index int, begin int, data []byte) error {
+	stored, e := m.piece(index, begin, len(data))
+	if e != nil {
+		return e
+	}
+	copy(data, stored)
+	return nil
+}
+
+func (m *Memory) WriteAt(index int, begin int, data []byte) error {
+	parts, e := spans(m.info, m.layout, index, begin, data)
+	if e != nil {
+		return e
+	}
+	offset := index*m.info.PieceLength + begin
+	for _, part := range parts {
+		if !part.padding {
+			copy(m.data[offset:], part.data)
+		}
+		offset += len(part.data)
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
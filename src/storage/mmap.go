@@ -0,0 +1,109 @@
+//go:build unix
+
+package storage
+
+import (
+	"bittorrent/src/decoder"
+	"errors"
+	"sync"
+	"syscall"
+)
+
+/*
+Mmap stores the torrent in its files like Files, mapped in memory so that
+reads and writes are copies. The kernel writes the pages back to the files,
+at the latest when the storage is closed.
+*/
+type Mmap struct {
+	completion
+	info   decoder.Info
+	layout decoder.Layout
+
+	// mu keeps the mappings while they are used, Close takes it for writing
+	mu       sync.RWMutex
+	mappings [][]byte // nil for padding and empty files
+	closed   bool
+}
+
+// NewMmap creates the files of the torrent under path as NewFiles does and maps them.
+func NewMmap(path string, info decoder.Info) (*Mmap, error) {
+	files, e := NewFiles(path, info, Sparse)
+	if e != nil {
+		return nil, e
+	}
+	// the mappings stay valid once the files are closed
+	defer files.Close()
+
+	s := &Mmap{
+		completion: newCompletion(info),
+		info:       info,
+		layout:     files.layout,
+		mappings:   make([][]byte, len(files.files)),
+	}
+	for i, file := range files.files {
+		if file == nil || s.layout[i].Length == 0 {
+			continue
+		}
+		mapping, e := syscall.Mmap(int(file.Fd()), 0, s.layout[i].Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if e != nil {
+			s.Close()
+			return nil, e
+		}
+		s.mappings[i] = mapping
+	}
+	return s, nil
+}
+
+func (s *Mmap) ReadAt(index int, begin int, data []byte) error {
+	parts, e := spans(s.info, s.layout, index, begin, data)
+	if e != nil {
+		return e
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, part := range parts {
+		if part.padding {
+			clear(part.data)
+			continue
+		}
+		copy(part.data, s.mappings[part.file][part.offset:])
+	}
+	return nil
+}
+
+func (s *Mmap) WriteAt(index int, begin int, data []byte) error {
+	parts, e := spans(s.info, s.layout, index, begin, data)
+	if e != nil {
+		return e
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, part := range parts {
+		if !part.padding {
+			copy(s.mappings[part.file][part.offset:], part.data)
+		}
+	}
+	return nil
+}
+
+func (s *Mmap) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	errs := []error{}
+	for _, mapping := range s.mappings {
+		if mapping != nil {
+			errs = append(errs, syscall.Munmap(mapping))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package storage
+
+import (
+	"bittorrent/src/decoder"
+	"errors"
+)
+
+// Mmap is only available on unix systems.
+type Mmap struct {
+	Files
+}
+
+func NewMmap(path string, info decoder.Info) (*Mmap, error) {
+	return nil, errors.New("mmap storage is not supported on this system")
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes of disk for the file without writing them.
+func preallocate(file *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(file.Fd()), 0, 0, size)
+}
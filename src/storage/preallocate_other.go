@@ -0,0 +1,28 @@
+//go:build !linux
+
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// preallocate reserves size bytes of disk for the file by writing zeros where there is no data yet.
+func preallocate(file *os.File, size int64) error {
+	info, e := file.Stat()
+	if e != nil {
+		return e
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	_, e = io.CopyN(io.NewOffsetWriter(file, info.Size()), zeros{}, size-info.Size())
+	return e
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrClosed is returned by storages that cannot be used once closed.
+var ErrClosed = errors.New("storage closed")
+
+/*
+Storage holds the data of a torrent, addressed by piece so that pieces can
+be written in any order. The torrent data is spread over the files of its
+layout, padding files are not stored and read as zeros.
+*/
+type Storage interface {
+	// ReadAt fills data with the bytes of piece index from begin
+	ReadAt(index int, begin int, data []byte) error
+	// WriteAt writes data in piece index at begin
+	WriteAt(index int, begin int, data []byte) error
+	// MarkComplete records that piece index is written and verified
+	MarkComplete(index int) error
+	Close() error
+}
+
+// ReadPiece reads a whole piece.
+func ReadPiece(s Storage, info decoder.Info, index int) ([]byte, error) {
+	piece := make([]byte, info.PieceSize(index))
+	return piece, s.ReadAt(index, 0, piece)
+}
+
+/*
+Verify checks every piece of the storage against its hash. The pieces that
+verify are marked complete and the others are returned.
+*/
+func Verify(s Storage, info decoder.Info) ([]int, error) {
+	bad := []int{}
+	for index := range info.NumPieces() {
+		piece, e := ReadPiece(s, info, index)
+		if e != nil {
+			return bad, e
+		}
+		if !info.VerifyPiece(index, piece) {
+			bad = append(bad, index)
+		} else if e := s.MarkComplete(index); e != nil {
+			return bad, e
+		}
+	}
+	return bad, nil
+}
+
+// completion keeps the pieces marked complete, for the implementations.
+type completion struct {
+	mu       sync.Mutex
+	complete protocol.Bitfield
+}
+
+func newCompletion(info decoder.Info) completion {
+	return completion{complete: protocol.NewBitfield(info.NumPieces())}
+}
+
+func (c *completion) MarkComplete(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 || index >= len(c.complete)*8 {
+		return fmt.Errorf("piece %d out of range", index)
+	}
+	c.complete.Set(index)
+	return nil
+}
+
+// Completed returns a copy of the pieces marked complete.
+func (c *completion) Completed() protocol.Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(protocol.Bitfield{}, c.complete...)
+}
+
+// pieceSpan is the part of a file a range of a piece covers.
+type pieceSpan struct {
+	file    int
+	offset  int64
+	data    []byte
+	padding bool
+}
+
+// spans maps data at begin of piece index to the files of the layout, a range outside of the piece is an error.
+func spans(info decoder.Info, layout decoder.Layout, index int, begin int, data []byte) ([]pieceSpan, error) {
+	if index < 0 || index >= info.NumPieces() || begin < 0 || begin+len(data) > info.PieceSize(index) {
+		return nil, fmt.Errorf("%d bytes at %d out of piece %d", len(data), begin, index)
+	}
+	result := []pieceSpan{}
+	done := 0
+	for _, span := range layout.Spans(index*info.PieceLength+begin, len(data)) {
+		result = append(result, pieceSpan{
+			file:    span.File,
+			offset:  int64(span.FileOffset),
+			data:    data[done : done+span.Length],
+			padding: layout[span.File].IsPadding(),
+		})
+		done += span.Length
+	}
+	return result, nil
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+/*
+testInfo is a torrent of 16 byte pieces whose files are, in order: a of 10
+bytes, an empty file, b of 21 bytes, 5 bytes of padding and c of 12 bytes.
+Pieces cross every file boundary. The content returned has zeros where
+the padding is.
+*/
+func testInfo() (decoder.Info, []byte) {
+	info := decoder.Info{
+		Name:        "torrent",
+		PieceLength: 16,
+		Files: []decoder.File{
+			{Length: 10, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 21, Path: []string{"dir", "b"}},
+			{Length: 5, Path: []string{".pad", "5"}, Attr: "p"},
+			{Length: 12, Path: []string{"c"}},
+		},
+	}
+	content := make([]byte, info.TotalLength())
+	rand.Read(content)
+	clear(content[31:36])
+	for start := 0; start < len(content); start += info.PieceLength {
+		hash := sha1.Sum(content[start:min(start+info.PieceLength, len(content))])
+		info.Pieces = append(info.Pieces, hash[:]...)
+	}
+	return info, content
+}
+
+// storages returns an empty storage of each kind for info.
+func storages(t *testing.T, info decoder.Info) map[string]Storage {
+	result := map[string]Storage{"memory": NewMemory(info)}
+	for name, allocation := range map[string]Allocation{"sparse": Sparse, "preallocate": Preallocate} {
+		files, e := NewFiles(t.TempDir(), info, allocation)
+		if e != nil {
+			t.Fatal(e)
+		}
+		t.Cleanup(func() { files.Close() })
+		result[name] = files
+	}
+	return result
+}
+
+// write stores content in blocks of 7 bytes, so that blocks cross file boundaries.
+func write(t *testing.T, s Storage, info decoder.Info, content []byte) {
+	for index := range info.NumPieces() {
+		piece := content[index*info.PieceLength : index*info.PieceLength+info.PieceSize(index)]
+		for begin := 0; begin < len(piece); begin += 7 {
+			if e := s.WriteAt(index, begin, piece[begin:min(begin+7, len(piece))]); e != nil {
+				t.Fatalf("WriteAt(%d, %d): %v", index, begin, e)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	info, content := testInfo()
+	for name, s := range storages(t, info) {
+		write(t, s, info, content)
+		for index := range info.NumPieces() {
+			piece, e := ReadPiece(s, info, index)
+			if e != nil {
+				t.Fatalf("%s: ReadPiece(%d): %v", name, index, e)
+			}
+			if want := content[index*info.PieceLength:][:info.PieceSize(index)]; !bytes.Equal(piece, want) {
+				t.Errorf("%s: piece %d = %x, want %x", name, index, piece, want)
+			}
+		}
+		// a range inside a piece, across the end of a and the start of b
+		block := make([]byte, 4)
+		if e := s.ReadAt(0, 8, block); e != nil || !bytes.Equal(block, content[8:12]) {
+			t.Errorf("%s: ReadAt(0, 8) = %x, %v; want %x", name, block, e, content[8:12])
+		}
+	}
+}
+
+func TestPaddingReadsZeros(t *testing.T) {
+	info, content := testInfo()
+	// the padding of the written data is not zero, it must not be kept
+	written := bytes.Clone(content)
+	for i := 31; i < 36; i++ {
+		written[i] = 0xff
+	}
+	for name, s := range storages(t, info) {
+		write(t, s, info, written)
+		piece, e := ReadPiece(s, info, 1)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(piece, content[16:32]) {
+			t.Errorf("%s: piece 1 = %x, want %x", name, piece, content[16:32])
+		}
+		if bad, e := Verify(s, info); e != nil || len(bad) != 0 {
+			t.Errorf("%s: Verify = %v, %v; want no bad pieces", name, bad, e)
+		}
+	}
+}
+
+func TestOutOfPiece(t *testing.T) {
+	info, _ := testInfo()
+	cases := []struct{ index, begin, length int }{
+		{-1, 0, 1},
+		{3, 0, 1},
+		{0, -1, 1},
+		{0, 10, 7},
+		// the last piece has 16 bytes
+		{2, 10, 7},
+	}
+	for name, s := range storages(t, info) {
+		for _, c := range cases {
+			data := make([]byte, c.length)
+			if e := s.WriteAt(c.index, c.begin, data); e == nil {
+				t.Errorf("%s: WriteAt(%d, %d) of %d bytes succeeded", name, c.index, c.begin, c.length)
+			}
+			if e := s.ReadAt(c.index, c.begin, data); e == nil {
+				t.Errorf("%s: ReadAt(%d, %d) of %d bytes succeeded", name, c.index, c.begin, c.length)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	info, content := testInfo()
+	for name, s := range storages(t, info) {
+		write(t, s, info, content)
+		// piece 1 holds the end of b and the start of c around the padding
+		if e := s.WriteAt(1, 14, []byte{content[30] ^ 1}); e != nil {
+			t.Fatal(e)
+		}
+		bad, e := Verify(s, info)
+		if e != nil || !slices.Equal(bad, []int{1}) {
+			t.Errorf("%s: Verify = %v, %v; want [1]", name, bad, e)
+		}
+		completed := s.(interface{ Completed() protocol.Bitfield }).Completed()
+		if !completed.Has(0) || completed.Has(1) || !completed.Has(2) {
+			t.Errorf("%s: completed %08b", name, completed)
+		}
+	}
+}
+
+func TestFilesOnDisk(t *testing.T) {
+	info, content := testInfo()
+	dir := t.TempDir()
+	files, e := NewFiles(dir, info, Sparse)
+	if e != nil {
+		t.Fatal(e)
+	}
+	write(t, files, info, content)
+	if e := files.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	sizes := map[string]int64{"a": 10, "empty": 0, "dir/b": 21, "c": 12}
+	for path, size := range sizes {
+		stat, e := os.Stat(filepath.Join(dir, "torrent", path))
+		if e != nil || stat.Size() != size {
+			t.Errorf("file %s: %v, want %d bytes", path, e, size)
+		}
+	}
+	if _, e := os.Stat(filepath.Join(dir, "torrent", ".pad")); !os.IsNotExist(e) {
+		t.Errorf("padding file created: %v", e)
+	}
+
+	// the data can be read back to seed it
+	files, e = OpenFiles(dir, info)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer files.Close()
+	if bad, e := Verify(files, info); e != nil || len(bad) != 0 {
+		t.Errorf("Verify of the reopened files = %v, %v", bad, e)
+	}
+	if e := files.WriteAt(0, 0, []byte{1}); e == nil {
+		t.Error("write to files opened for reading succeeded")
+	}
+}
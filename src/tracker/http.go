@@ -0,0 +1,167 @@
+package tracker
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// httpPeer is a peer of the non compact peer list.
+type httpPeer struct {
+	IP     string `bencode:"ip"`
+	PeerId string `bencode:"peer id,omitempty"`
+	Port   int    `bencode:"port"`
+}
+
+/*
+ServeHTTP answers /announce and /scrape, or /<passkey>/announce,
+/<passkey>/scrape and /<passkey>/stats when passkeys are used. Errors are
+sent to the client as a bencoded failure reason.
+*/
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	passkey, action := "", strings.TrimPrefix(r.URL.Path, "/")
+	if i := strings.LastIndex(action, "/"); i >= 0 {
+		passkey, action = action[:i], action[i+1:]
+	}
+	query := r.URL.Query()
+
+	switch action {
+	case "announce":
+		t.serveAnnounce(w, r, query, passkey)
+	case "scrape":
+		hashes := [][]byte{}
+		for _, hash := range query["info_hash"] {
+			hashes = append(hashes, []byte(hash))
+		}
+		results, e := t.Scrape(hashes)
+		if e != nil {
+			writeFailure(w, e)
+			return
+		}
+		files := map[string]protocol.ScrapeFile{}
+		for _, result := range results {
+			files[string(result.InfoHash)] = protocol.ScrapeFile{
+				Complete:   result.Complete,
+				Downloaded: result.Downloaded,
+				Incomplete: result.Incomplete,
+			}
+		}
+		writeBencode(w, map[string]any{"files": files})
+	case "stats":
+		stats, ok := t.Stats(passkey)
+		if !ok {
+			writeFailure(w, ErrUnknownPasskey)
+			return
+		}
+		writeBencode(w, stats)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *Tracker) serveAnnounce(w http.ResponseWriter, r *http.Request, query url.Values, passkey string) {
+	if passkey == "" {
+		passkey = query.Get("passkey")
+	}
+	req := AnnounceRequest{
+		InfoHash: []byte(query.Get("info_hash")),
+		PeerId:   query.Get("peer_id"),
+		NumWant:  -1,
+		Passkey:  passkey,
+	}
+	var e error
+	if req.Port, e = strconv.Atoi(query.Get("port")); e != nil {
+		writeFailure(w, ErrInvalidRequest)
+		return
+	}
+	for name, counter := range map[string]*int64{
+		"uploaded":   &req.Uploaded,
+		"downloaded": &req.Downloaded,
+		"left":       &req.Left,
+	} {
+		if *counter, e = strconv.ParseInt(query.Get(name), 10, 64); e != nil {
+			writeFailure(w, ErrInvalidRequest)
+			return
+		}
+	}
+	if numWant, e := strconv.Atoi(query.Get("numwant")); e == nil {
+		req.NumWant = numWant
+	}
+	switch query.Get("event") {
+	case "started":
+		req.Event = protocol.EventStarted
+	case "completed":
+		req.Event = protocol.EventCompleted
+	case "stopped":
+		req.Event = protocol.EventStopped
+	}
+	if host, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		req.IP = net.ParseIP(host)
+	}
+	if v4 := req.IP.To4(); v4 != nil {
+		req.IP = v4
+	}
+
+	resp, e := t.Announce(req)
+	if e != nil {
+		writeFailure(w, e)
+		return
+	}
+	body := map[string]any{
+		"complete":   resp.Complete,
+		"incomplete": resp.Incomplete,
+		"interval":   resp.Interval,
+	}
+	if resp.MinInterval > 0 {
+		body["min interval"] = resp.MinInterval
+	}
+	if query.Get("compact") == "0" {
+		peers := []httpPeer{}
+		for _, p := range resp.Peers {
+			peer := httpPeer{IP: p.IP.String(), Port: p.Port}
+			if query.Get("no_peer_id") != "1" {
+				peer.PeerId = p.PeerId
+			}
+			peers = append(peers, peer)
+		}
+		body["peers"] = peers
+	} else {
+		peers, peers6 := compactPeers(resp.Peers)
+		body["peers"] = peers
+		if len(peers6) > 0 {
+			body["peers6"] = peers6
+		}
+	}
+	writeBencode(w, body)
+}
+
+// compactPeers returns the compact IPv4 and IPv6 peer lists.
+func compactPeers(peers []protocol.IP) ([]byte, []byte) {
+	peers4, peers6 := []byte{}, []byte{}
+	for _, p := range peers {
+		if v4 := p.IP.To4(); v4 != nil {
+			peers4 = append(peers4, v4...)
+			peers4 = binary.BigEndian.AppendUint16(peers4, uint16(p.Port))
+		} else {
+			peers6 = append(peers6, p.IP.To16()...)
+			peers6 = binary.BigEndian.AppendUint16(peers6, uint16(p.Port))
+		}
+	}
+	return peers4, peers6
+}
+
+func writeFailure(w http.ResponseWriter, e error) {
+	writeBencode(w, map[string]any{"failure reason": e.Error()})
+}
+
+func writeBencode(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "text/plain")
+	if e := decoder.NewEncoder(w).Encode(v); e != nil {
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,145 @@
+package tracker
+
+import (
+	"bittorrent/src/decoder"
+	"bittorrent/src/protocol"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// serveHTTP runs the tracker on a test server and returns its URL.
+func serveHTTP(t *testing.T, tracker *Tracker) string {
+	server := httptest.NewServer(tracker)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// get decodes the bencoded answer to a request of the tracker.
+func get(t *testing.T, url string) map[string]any {
+	resp, e := http.Get(url)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer resp.Body.Close()
+	body, e := io.ReadAll(resp.Body)
+	if e != nil {
+		t.Fatal(e)
+	}
+	v, e := decoder.Decode(body)
+	if e != nil {
+		t.Fatalf("GET %s: %v", url, e)
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		t.Fatalf("GET %s: %#v", url, v)
+	}
+	return dict
+}
+
+func TestHTTPAnnounceCompact(t *testing.T) {
+	tracker := New(Config{})
+	// the test server sees the client as 127.0.0.1
+	tracker.Announce(request(1, 100))
+	client := &protocol.HTTPTracker{URL: serveHTTP(t, tracker) + "/announce"}
+
+	resp, e := client.Announce(protocol.AnnounceParams{
+		InfoHash: testHash,
+		PeerId:   request(2, 0).PeerId,
+		Port:     6882,
+		Left:     100,
+		Event:    protocol.EventStarted,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Incomplete != 2 || len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("announce response %+v", resp)
+	}
+	if results, e := tracker.Scrape([][]byte{testHash}); e != nil || results[0].Incomplete != 2 {
+		t.Errorf("tracker did not record the HTTP peer: %+v, %v", results, e)
+	}
+}
+
+func TestHTTPAnnounceDict(t *testing.T) {
+	tracker := New(Config{})
+	tracker.Announce(request(1, 100))
+	query := url.Values{
+		"info_hash":  {string(testHash)},
+		"peer_id":    {request(2, 0).PeerId},
+		"port":       {"6882"},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"left":       {"0"},
+		"compact":    {"0"},
+	}
+	body := get(t, serveHTTP(t, tracker)+"/announce?"+query.Encode())
+	want := []any{map[string]any{"ip": "10.0.0.1", "peer id": request(1, 0).PeerId, "port": 6881}}
+	if !reflect.DeepEqual(body["peers"], want) {
+		t.Errorf("peers %#v, want %#v", body["peers"], want)
+	}
+
+	query.Set("no_peer_id", "1")
+	body = get(t, serveHTTP(t, tracker)+"/announce?"+query.Encode())
+	want = []any{map[string]any{"ip": "10.0.0.1", "port": 6881}}
+	if !reflect.DeepEqual(body["peers"], want) {
+		t.Errorf("peers without ids %#v, want %#v", body["peers"], want)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	tracker := New(Config{})
+	tracker.Announce(request(1, 0))
+	tracker.Announce(request(2, 100))
+	client := &protocol.HTTPTracker{URL: serveHTTP(t, tracker) + "/announce"}
+
+	other := make([]byte, 20)
+	results, e := client.Scrape([][]byte{testHash, other})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(results) != 2 || results[0].Complete != 1 || results[0].Incomplete != 1 || results[1].Complete != 0 {
+		t.Errorf("scrape results %+v", results)
+	}
+}
+
+func TestHTTPAllowed(t *testing.T) {
+	tracker := New(Config{Allowed: [][]byte{testHash}})
+	client := &protocol.HTTPTracker{URL: serveHTTP(t, tracker) + "/announce"}
+	_, e := client.Announce(protocol.AnnounceParams{InfoHash: make([]byte, 20), PeerId: request(1, 0).PeerId, Port: 6881})
+	var failure *protocol.FailureError
+	if !errors.As(e, &failure) || failure.Reason != ErrUnknownTorrent.Error() {
+		t.Errorf("announce of another torrent = %v, want %v", e, ErrUnknownTorrent)
+	}
+}
+
+func TestHTTPPasskey(t *testing.T) {
+	tracker := New(Config{Passkeys: []string{"key"}})
+	base := serveHTTP(t, tracker)
+	params := protocol.AnnounceParams{InfoHash: testHash, PeerId: request(1, 0).PeerId, Port: 6881, Uploaded: 300}
+
+	var failure *protocol.FailureError
+	if _, e := (&protocol.HTTPTracker{URL: base + "/other/announce"}).Announce(params); !errors.As(e, &failure) {
+		t.Errorf("announce with an unknown passkey = %v", e)
+	}
+	if _, e := (&protocol.HTTPTracker{URL: base + "/key/announce"}).Announce(params); e != nil {
+		t.Fatal(e)
+	}
+	// the passkey can also be in the query
+	params.Uploaded = 500
+	if _, e := (&protocol.HTTPTracker{URL: base + "/announce?passkey=key"}).Announce(params); e != nil {
+		t.Fatal(e)
+	}
+	stats := get(t, base+"/key/stats")
+	want := map[string]any{"uploaded": 500, "downloaded": 0, "completed": 0, "announces": 2}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats %#v, want %#v", stats, want)
+	}
+	if stats := get(t, base+"/other/stats"); stats["failure reason"] != ErrUnknownPasskey.Error() {
+		t.Errorf("stats of an unknown passkey %#v", stats)
+	}
+}
@@ -0,0 +1,304 @@
+package tracker
+
+import (
+	"bittorrent/src/protocol"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownTorrent = errors.New("torrent not registered with this tracker")
+	ErrUnknownPasskey = errors.New("unknown passkey")
+	ErrInvalidRequest = errors.New("invalid announce request")
+)
+
+type Config struct {
+	// Interval is sent to clients as the time between announces
+	Interval    time.Duration
+	MinInterval time.Duration
+	// PeerTimeout drops peers that did not announce for this long, 0 is twice Interval
+	PeerTimeout time.Duration
+	// MaxNumWant caps the peers sent in one answer
+	MaxNumWant int
+	// Allowed restricts the tracker to these info hashes, empty allows any torrent
+	Allowed [][]byte
+	// Passkeys, when not empty, are the only keys accepted on announces
+	Passkeys []string
+}
+
+// AnnounceRequest is an announce as received over HTTP or UDP.
+type AnnounceRequest struct {
+	InfoHash   []byte
+	PeerId     string
+	IP         net.IP
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      protocol.Event
+	NumWant    int // negative for the default
+	Passkey    string
+}
+
+type AnnounceResponse struct {
+	Interval    int64
+	MinInterval int64
+	Complete    int64
+	Incomplete  int64
+	Peers       []protocol.IP
+}
+
+// PasskeyStats are the totals reported by the clients of one passkey.
+type PasskeyStats struct {
+	Uploaded   int64 `bencode:"uploaded"`
+	Downloaded int64 `bencode:"downloaded"`
+	Completed  int64 `bencode:"completed"`
+	Announces  int64 `bencode:"announces"`
+}
+
+type peer struct {
+	protocol.IP
+	uploaded   int64
+	downloaded int64
+	left       int64
+	seen       time.Time
+}
+
+type swarm struct {
+	peers map[string]*peer // by peer id
+	// downloaded counts completed events
+	downloaded int64
+}
+
+/*
+Tracker keeps the swarms of the torrents announced to it in memory. It is
+safe for concurrent use by the HTTP and UDP servers.
+*/
+type Tracker struct {
+	interval    time.Duration
+	minInterval time.Duration
+	peerTimeout time.Duration
+	maxNumWant  int
+	allowed     map[string]bool
+	passkeys    map[string]bool
+
+	mu     sync.Mutex
+	swarms map[string]*swarm // by info hash
+	stats  map[string]*PasskeyStats
+}
+
+func New(config Config) *Tracker {
+	t := &Tracker{
+		interval:    config.Interval,
+		minInterval: config.MinInterval,
+		peerTimeout: config.PeerTimeout,
+		maxNumWant:  config.MaxNumWant,
+		swarms:      make(map[string]*swarm),
+		stats:       make(map[string]*PasskeyStats),
+	}
+	if t.interval <= 0 {
+		t.interval = 30 * time.Minute
+	}
+	if t.peerTimeout <= 0 {
+		t.peerTimeout = 2 * t.interval
+	}
+	if t.maxNumWant <= 0 {
+		t.maxNumWant = 50
+	}
+	if len(config.Allowed) > 0 {
+		t.allowed = make(map[string]bool)
+		for _, hash := range config.Allowed {
+			t.allowed[string(hash)] = true
+		}
+	}
+	if len(config.Passkeys) > 0 {
+		t.passkeys = make(map[string]bool)
+		for _, key := range config.Passkeys {
+			t.passkeys[key] = true
+		}
+	}
+	return t
+}
+
+// RequiresPasskey tells if announces without a valid passkey are refused.
+func (t *Tracker) RequiresPasskey() bool {
+	return t.passkeys != nil
+}
+
+func (t *Tracker) checkTorrent(infoHash []byte) error {
+	if len(infoHash) != 20 {
+		return ErrInvalidRequest
+	}
+	if t.allowed != nil && !t.allowed[string(infoHash)] {
+		return ErrUnknownTorrent
+	}
+	return nil
+}
+
+/*
+Announce records the peer in the swarm of the torrent and returns other
+peers of the swarm, chosen at random. A stopped event removes the peer.
+*/
+func (t *Tracker) Announce(req AnnounceRequest) (AnnounceResponse, error) {
+	if e := t.checkTorrent(req.InfoHash); e != nil {
+		return AnnounceResponse{}, e
+	}
+	if len(req.PeerId) != 20 || req.Port <= 0 || req.Port > 65535 || req.IP == nil {
+		return AnnounceResponse{}, ErrInvalidRequest
+	}
+	if t.passkeys != nil && !t.passkeys[req.Passkey] {
+		return AnnounceResponse{}, ErrUnknownPasskey
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	s := t.swarms[string(req.InfoHash)]
+	if s == nil {
+		s = &swarm{peers: make(map[string]*peer)}
+		t.swarms[string(req.InfoHash)] = s
+	}
+	s.expire(now.Add(-t.peerTimeout))
+
+	p := s.peers[req.PeerId]
+	if p == nil {
+		p = &peer{}
+	}
+	if t.passkeys != nil {
+		stats := t.stats[req.Passkey]
+		if stats == nil {
+			stats = &PasskeyStats{}
+			t.stats[req.Passkey] = stats
+		}
+		// counters are totals since the client started, only count what is new
+		stats.Uploaded += max(0, req.Uploaded-p.uploaded)
+		stats.Downloaded += max(0, req.Downloaded-p.downloaded)
+		stats.Announces++
+		if req.Event == protocol.EventCompleted {
+			stats.Completed++
+		}
+	}
+	if req.Event == protocol.EventCompleted {
+		s.downloaded++
+	}
+	if req.Event == protocol.EventStopped {
+		delete(s.peers, req.PeerId)
+	} else {
+		p.IP = protocol.IP{IP: req.IP, Port: req.Port, PeerId: req.PeerId}
+		p.uploaded = req.Uploaded
+		p.downloaded = req.Downloaded
+		p.left = req.Left
+		p.seen = now
+		s.peers[req.PeerId] = p
+	}
+
+	numWant := req.NumWant
+	if numWant < 0 || numWant > t.maxNumWant {
+		numWant = t.maxNumWant
+	}
+	complete, incomplete := s.counts()
+	resp := AnnounceResponse{
+		Interval:    int64(t.interval / time.Second),
+		MinInterval: int64(t.minInterval / time.Second),
+		Complete:    complete,
+		Incomplete:  incomplete,
+	}
+	if req.Event != protocol.EventStopped {
+		resp.Peers = s.pick(req.PeerId, numWant, req.Left == 0)
+	}
+	return resp, nil
+}
+
+/*
+Scrape returns the counters of each info hash, in the same order. With no
+info hashes every swarm is returned.
+*/
+func (t *Tracker) Scrape(infoHashes [][]byte) ([]protocol.ScrapeResult, error) {
+	for _, hash := range infoHashes {
+		if e := t.checkTorrent(hash); e != nil {
+			return nil, e
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(infoHashes) == 0 {
+		for hash := range t.swarms {
+			infoHashes = append(infoHashes, []byte(hash))
+		}
+	}
+	expired := time.Now().Add(-t.peerTimeout)
+	results := []protocol.ScrapeResult{}
+	for _, hash := range infoHashes {
+		result := protocol.ScrapeResult{InfoHash: hash}
+		if s := t.swarms[string(hash)]; s != nil {
+			s.expire(expired)
+			result.Complete, result.Incomplete = s.counts()
+			result.Downloaded = s.downloaded
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Stats returns the totals of a passkey.
+func (t *Tracker) Stats(passkey string) (PasskeyStats, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats, ok := t.stats[passkey]
+	if !ok {
+		return PasskeyStats{}, t.passkeys[passkey]
+	}
+	return *stats, true
+}
+
+// Sweep drops expired peers, and swarms left without peers. It should be called periodically.
+func (t *Tracker) Sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expired := time.Now().Add(-t.peerTimeout)
+	for hash, s := range t.swarms {
+		s.expire(expired)
+		if len(s.peers) == 0 {
+			delete(t.swarms, hash)
+		}
+	}
+}
+
+func (s *swarm) expire(before time.Time) {
+	for id, p := range s.peers {
+		if p.seen.Before(before) {
+			delete(s.peers, id)
+		}
+	}
+}
+
+// counts returns the number of seeders and leechers.
+func (s *swarm) counts() (int64, int64) {
+	var complete, incomplete int64
+	for _, p := range s.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// pick returns up to n random peers other than self, seeders only get leechers.
+func (s *swarm) pick(self string, n int, seeder bool) []protocol.IP {
+	peers := []protocol.IP{}
+	for id, p := range s.peers {
+		if id == self || (seeder && p.left == 0) {
+			continue
+		}
+		peers = append(peers, p.IP)
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	return peers[:min(n, len(peers))]
+}
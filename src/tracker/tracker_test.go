@@ -0,0 +1,145 @@
+package tracker
+
+import (
+	"bittorrent/src/protocol"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var testHash = bytes.Repeat([]byte{1}, 20)
+
+// request is an announce of peer n of testHash, from 10.0.0.n:6881.
+func request(n int, left int64) AnnounceRequest {
+	return AnnounceRequest{
+		InfoHash: testHash,
+		PeerId:   fmt.Sprintf("-GO0001-%012d", n),
+		IP:       net.IPv4(10, 0, 0, byte(n)).To4(),
+		Port:     6881,
+		Left:     left,
+		Event:    protocol.EventStarted,
+		NumWant:  -1,
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	tracker := New(Config{Interval: time.Minute})
+	for n := 1; n <= 3; n++ {
+		if _, e := tracker.Announce(request(n, 100)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	seeder := request(4, 0)
+	resp, e := tracker.Announce(seeder)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Interval != 60 || resp.Complete != 1 || resp.Incomplete != 3 || len(resp.Peers) != 3 {
+		t.Errorf("announce response %+v", resp)
+	}
+	for _, p := range resp.Peers {
+		if p.PeerId == seeder.PeerId {
+			t.Errorf("peer got itself back")
+		}
+	}
+
+	// a seeder only gets leechers, so another seeder sees the 3 of them
+	seeder = request(5, 0)
+	seeder.NumWant = 2
+	if resp, e = tracker.Announce(seeder); e != nil || len(resp.Peers) != 2 {
+		t.Errorf("announce with numwant 2 = %d peers, %v", len(resp.Peers), e)
+	}
+
+	stopped := request(1, 100)
+	stopped.Event = protocol.EventStopped
+	if resp, e = tracker.Announce(stopped); e != nil || resp.Incomplete != 2 || len(resp.Peers) != 0 {
+		t.Errorf("stopped announce = %+v, %v", resp, e)
+	}
+}
+
+func TestAnnounceInvalid(t *testing.T) {
+	tracker := New(Config{})
+	cases := []func(*AnnounceRequest){
+		func(r *AnnounceRequest) { r.InfoHash = testHash[:19] },
+		func(r *AnnounceRequest) { r.PeerId = "short" },
+		func(r *AnnounceRequest) { r.Port = 0 },
+		func(r *AnnounceRequest) { r.Port = 65536 },
+		func(r *AnnounceRequest) { r.IP = nil },
+	}
+	for i, change := range cases {
+		req := request(1, 100)
+		change(&req)
+		if _, e := tracker.Announce(req); !errors.Is(e, ErrInvalidRequest) {
+			t.Errorf("case %d: Announce = %v, want %v", i, e, ErrInvalidRequest)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	other := bytes.Repeat([]byte{2}, 20)
+	tracker := New(Config{Allowed: [][]byte{testHash}})
+	if _, e := tracker.Announce(request(1, 100)); e != nil {
+		t.Fatal(e)
+	}
+	req := request(1, 100)
+	req.InfoHash = other
+	if _, e := tracker.Announce(req); !errors.Is(e, ErrUnknownTorrent) {
+		t.Errorf("Announce of another torrent = %v, want %v", e, ErrUnknownTorrent)
+	}
+	if _, e := tracker.Scrape([][]byte{testHash, other}); !errors.Is(e, ErrUnknownTorrent) {
+		t.Errorf("Scrape of another torrent = %v, want %v", e, ErrUnknownTorrent)
+	}
+}
+
+func TestPasskeyStats(t *testing.T) {
+	tracker := New(Config{Passkeys: []string{"key"}})
+	req := request(1, 100)
+	if _, e := tracker.Announce(req); !errors.Is(e, ErrUnknownPasskey) {
+		t.Errorf("Announce without passkey = %v, want %v", e, ErrUnknownPasskey)
+	}
+
+	req.Passkey = "key"
+	req.Uploaded, req.Downloaded = 100, 50
+	if _, e := tracker.Announce(req); e != nil {
+		t.Fatal(e)
+	}
+	// counters are totals, only what is new since the last announce counts
+	req.Uploaded, req.Downloaded, req.Left = 250, 150, 0
+	req.Event = protocol.EventCompleted
+	if _, e := tracker.Announce(req); e != nil {
+		t.Fatal(e)
+	}
+	stats, ok := tracker.Stats("key")
+	want := PasskeyStats{Uploaded: 250, Downloaded: 150, Completed: 1, Announces: 2}
+	if !ok || stats != want {
+		t.Errorf("Stats = %+v, %v; want %+v", stats, ok, want)
+	}
+	if _, ok := tracker.Stats("other"); ok {
+		t.Error("stats of an unknown passkey")
+	}
+}
+
+func TestPeerExpiry(t *testing.T) {
+	tracker := New(Config{PeerTimeout: 50 * time.Millisecond})
+	if _, e := tracker.Announce(request(1, 100)); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(100 * time.Millisecond)
+	resp, e := tracker.Announce(request(2, 100))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Incomplete != 1 || len(resp.Peers) != 0 {
+		t.Errorf("announce after expiry %+v", resp)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	tracker.Sweep()
+	// no info hash scrapes every swarm, the empty one was dropped
+	if results, e := tracker.Scrape(nil); e != nil || len(results) != 0 {
+		t.Errorf("Scrape after Sweep = %+v, %v", results, e)
+	}
+}
@@ -0,0 +1,151 @@
+package tracker
+
+import (
+	"bittorrent/src/protocol"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// requests are small, the largest is a scrape of UDPMaxScrapeHashes
+	udpMaxPacketSize = 2048
+	// connection ids are valid for one to two of these periods
+	udpConnectionIdPeriod = time.Minute
+)
+
+/*
+ServeUDP answers the UDP tracker protocol on conn until it is closed.
+Connection ids are derived from the client address and the time, so no
+state is kept between the connect and the requests that use it.
+Passkeys cannot be sent over UDP, so when they are required every UDP
+announce is refused.
+*/
+func (t *Tracker) ServeUDP(conn net.PacketConn) error {
+	secret := make([]byte, 32)
+	if _, e := rand.Read(secret); e != nil {
+		return e
+	}
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, e := conn.ReadFrom(buffer)
+		if e != nil {
+			if errors.Is(e, net.ErrClosed) {
+				return nil
+			}
+			return e
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		resp := t.handleUDP(buffer[:n], udpAddr, secret)
+		if resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (t *Tracker) handleUDP(packet []byte, addr *net.UDPAddr, secret []byte) []byte {
+	connId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := packet[12:16]
+	body := packet[16:]
+	now := time.Now()
+
+	if action == protocol.UDPActionConnect {
+		if connId != protocol.UDPProtocolId {
+			return nil
+		}
+		resp := binary.BigEndian.AppendUint32(nil, protocol.UDPActionConnect)
+		resp = append(resp, transactionId...)
+		return binary.BigEndian.AppendUint64(resp, connectionId(secret, addr, now))
+	}
+	// ids from the current or the previous period are valid
+	if connId != connectionId(secret, addr, now) &&
+		connId != connectionId(secret, addr, now.Add(-udpConnectionIdPeriod)) {
+		return udpError(transactionId, "invalid connection id")
+	}
+
+	switch action {
+	case protocol.UDPActionAnnounce:
+		if len(body) < 82 {
+			return udpError(transactionId, ErrInvalidRequest.Error())
+		}
+		if t.RequiresPasskey() {
+			return udpError(transactionId, ErrUnknownPasskey.Error())
+		}
+		ip := addr.IP
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		resp, e := t.Announce(AnnounceRequest{
+			InfoHash:   body[0:20],
+			PeerId:     string(body[20:40]),
+			Downloaded: int64(binary.BigEndian.Uint64(body[40:48])),
+			Left:       int64(binary.BigEndian.Uint64(body[48:56])),
+			Uploaded:   int64(binary.BigEndian.Uint64(body[56:64])),
+			Event:      protocol.Event(binary.BigEndian.Uint32(body[64:68])),
+			// the ip and key fields are ignored, the sender address is used
+			NumWant: int(int32(binary.BigEndian.Uint32(body[76:80]))),
+			Port:    int(binary.BigEndian.Uint16(body[80:82])),
+			IP:      ip,
+		})
+		if e != nil {
+			return udpError(transactionId, e.Error())
+		}
+		out := binary.BigEndian.AppendUint32(nil, protocol.UDPActionAnnounce)
+		out = append(out, transactionId...)
+		out = binary.BigEndian.AppendUint32(out, uint32(resp.Interval))
+		out = binary.BigEndian.AppendUint32(out, uint32(resp.Incomplete))
+		out = binary.BigEndian.AppendUint32(out, uint32(resp.Complete))
+		// peers are sent in the address family of the client
+		peers4, peers6 := compactPeers(resp.Peers)
+		if len(ip) == net.IPv4len {
+			out = append(out, peers4...)
+		} else {
+			out = append(out, peers6...)
+		}
+		return out
+	case protocol.UDPActionScrape:
+		hashes := [][]byte{}
+		for i := 0; i+20 <= len(body) && len(hashes) < protocol.UDPMaxScrapeHashes; i += 20 {
+			hashes = append(hashes, body[i:i+20])
+		}
+		if len(hashes) == 0 {
+			return udpError(transactionId, ErrInvalidRequest.Error())
+		}
+		results, e := t.Scrape(hashes)
+		if e != nil {
+			return udpError(transactionId, e.Error())
+		}
+		out := binary.BigEndian.AppendUint32(nil, protocol.UDPActionScrape)
+		out = append(out, transactionId...)
+		for _, result := range results {
+			out = binary.BigEndian.AppendUint32(out, uint32(result.Complete))
+			out = binary.BigEndian.AppendUint32(out, uint32(result.Downloaded))
+			out = binary.BigEndian.AppendUint32(out, uint32(result.Incomplete))
+		}
+		return out
+	}
+	return udpError(transactionId, "unknown action")
+}
+
+// connectionId signs the client address and the period of now.
+func connectionId(secret []byte, addr *net.UDPAddr, now time.Time) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(addr.IP.To16())
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(addr.Port)))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(now.Unix()/int64(udpConnectionIdPeriod/time.Second))))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func udpError(transactionId []byte, message string) []byte {
+	out := binary.BigEndian.AppendUint32(nil, protocol.UDPActionError)
+	out = append(out, transactionId...)
+	return append(out, message...)
+}
@@ -0,0 +1,97 @@
+package tracker
+
+import (
+	"bittorrent/src/protocol"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveUDP runs the tracker on a loopback UDP socket and returns a client for it.
+func serveUDP(t *testing.T, tracker *Tracker) *protocol.UDPTracker {
+	conn, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go tracker.ServeUDP(conn)
+	client, e := protocol.NewUDPTracker("udp://" + conn.LocalAddr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	client.Timeout = 200 * time.Millisecond
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	tracker := New(Config{Interval: time.Minute})
+	tracker.Announce(request(1, 100))
+	client := serveUDP(t, tracker)
+
+	resp, e := client.Announce(protocol.AnnounceParams{
+		InfoHash: testHash,
+		PeerId:   request(2, 0).PeerId,
+		Port:     6882,
+		Left:     100,
+		Event:    protocol.EventStarted,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Interval != 60 || resp.Incomplete != 2 || len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("announce response %+v", resp)
+	}
+	// the peer is recorded with the address it sent from
+	local, e := tracker.Announce(request(3, 100))
+	if e != nil {
+		t.Fatal(e)
+	}
+	found := false
+	for _, p := range local.Peers {
+		found = found || p.String() == "127.0.0.1:6882"
+	}
+	if !found {
+		t.Errorf("UDP peer missing from %v", local.Peers)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	tracker := New(Config{})
+	tracker.Announce(request(1, 0))
+	tracker.Announce(request(2, 100))
+	completed := request(2, 0)
+	completed.Event = protocol.EventCompleted
+	tracker.Announce(completed)
+	client := serveUDP(t, tracker)
+
+	other := make([]byte, 20)
+	results, e := client.Scrape([][]byte{testHash, other})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(results) != 2 || !bytes.Equal(results[0].InfoHash, testHash) ||
+		results[0].Complete != 2 || results[0].Downloaded != 1 || results[1].Complete != 0 {
+		t.Errorf("scrape results %+v", results)
+	}
+}
+
+func TestUDPRefused(t *testing.T) {
+	params := protocol.AnnounceParams{InfoHash: make([]byte, 20), PeerId: request(1, 0).PeerId, Port: 6881}
+	cases := []struct {
+		config Config
+		err    error
+	}{
+		{Config{Allowed: [][]byte{testHash}}, ErrUnknownTorrent},
+		// passkeys cannot be sent over UDP
+		{Config{Passkeys: []string{"key"}}, ErrUnknownPasskey},
+	}
+	for _, c := range cases {
+		client := serveUDP(t, New(c.config))
+		if _, e := client.Announce(params); e == nil || !strings.Contains(e.Error(), c.err.Error()) {
+			t.Errorf("Announce = %v, want %v", e, c.err)
+		}
+	}
+}